@@ -2,7 +2,6 @@ package cli
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/peterh/liner"
@@ -27,6 +26,10 @@ func StartConsole() {
 		if len(parts) == 0 {
 			continue
 		}
+		if parts[0] == "exit" {
+			// 返回给 main，由它清理路由并关闭日志
+			return
+		}
 
 		if err := handleCommand(parts); err != nil {
 			fmt.Printf("Error: %v\n", err)
@@ -40,10 +43,10 @@ func getCompleter() func(string) []string {
 			"help", "auto-subscribe true", "auto-subscribe false", "update-period", "update-now",
 			"show-config", "show-iface", "reload-config", "exit",
 			"check-openvpn-on", "check-openvpn-off", "start", "startv",
-			"view-log err", "view-log info", "view-log direct", "view-log vpn",
+			"view-log err", "view-log info", "view-log direct", "view-log vpn", "view-log block",
 			"set-log-level info", "set-log-level err", "set-log-level vpn",
 			"clear-logs", "compress-logs", "clear", "test", "rtest",
-			"status",
+			"status", "upstreams", "cache-stats",
 		}
 		for _, cmd := range commands {
 			if strings.HasPrefix(cmd, line) {
@@ -58,8 +61,6 @@ func handleCommand(parts []string) error {
 	switch parts[0] {
 	case "help":
 		printHelp()
-	case "exit":
-		os.Exit(0)
 	case "status":
 		printStatus()
 	case "auto-subscribe":
@@ -96,6 +97,10 @@ func handleCommand(parts []string) error {
 		return handleTest(parts)
 	case "rtest":
 		return handleRTest(parts)
+	case "upstreams":
+		printUpstreams()
+	case "cache-stats":
+		printCacheStats()
 	default:
 		return fmt.Errorf("unknown command: %s", parts[0])
 	}
@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
@@ -11,7 +12,10 @@ import (
 	"openvpnadvanced/cmd/config"
 	"openvpnadvanced/cmd/core"
 	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
 	"openvpnadvanced/fetcher"
+	"openvpnadvanced/geoip"
+	"openvpnadvanced/ruleset"
 	"openvpnadvanced/vpn"
 )
 
@@ -33,13 +37,16 @@ func printHelp() {
   view-log info - Show all logs
   view-log direct - Show lines with [DIRECT]
   view-log vpn - Show lines with [VPN]
+  view-log block - Show lines with [BLOCK]
   set-log-level info/err/vpn - Set logging level
   clear-logs - Clear all log files
   compress-logs - Archive all log files into a zip
   clear - Clear console output
   test <domain> - Check if a domain will be routed via VPN or direct
   rtest <domain> - Check routing and interface info for a domain
-  status - Show current running status of the core and VPN client`)
+  status - Show current running status of the core and VPN client
+  upstreams - Show upstream DNS servers ranked by latency score
+  cache-stats - Show DNS cache size, hit rate, evictions and stale answers`)
 }
 
 func printStatus() {
@@ -60,6 +67,40 @@ func printStatus() {
 	}
 }
 
+func printUpstreams() {
+	client := doh.DefaultClient()
+	fmt.Printf("Strategy: %s\n", client.Strategy)
+	for i, score := range client.Scores() {
+		latency := "-"
+		if score.Queries > 0 {
+			latency = score.Latency.Round(time.Millisecond).String()
+		}
+		fmt.Printf("%2d. %-50s latency=%-8s queries=%-6d failures=%d\n",
+			i+1, score.Upstream, latency, score.Queries, score.Failures)
+	}
+}
+
+func printCacheStats() {
+	cache := core.Cache()
+	if cache == nil {
+		fmt.Println("🛑 Core logic is not running.")
+		return
+	}
+	stats := cache.Stats()
+	hitRate := 0.0
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		hitRate = float64(stats.Hits) / float64(lookups) * 100
+	}
+	fmt.Printf("Entries:   %d / %d\n", stats.Entries, cache.MaxEntries)
+	fmt.Printf("Memory:    %.1f KiB / %d MiB\n", float64(stats.Bytes)/1024, cache.MaxBytes>>20)
+	fmt.Printf("Hits:      %d (%.1f%%)\n", stats.Hits, hitRate)
+	fmt.Printf("Misses:    %d\n", stats.Misses)
+	fmt.Printf("Evictions: %d\n", stats.Evictions)
+	fmt.Printf("Expired:   %d\n", stats.Expired)
+	fmt.Printf("Stale:     %d\n", stats.Stale)
+	fmt.Printf("Prefetch:  %d\n", stats.Prefetches)
+}
+
 func handleAutoSubscribe(parts []string) error {
 	if len(parts) < 2 {
 		return fmt.Errorf("missing value: true or false")
@@ -107,6 +148,19 @@ func showConfig() {
 		"Update Period":  cfg.UpdatePeriod.String(),
 		"Check OpenVPN":  fmt.Sprintf("%v", cfg.CheckOpenVPN),
 		"Log Level":      cfg.LogLevel,
+		"Upstreams":      upstreamList(cfg.Upstreams),
+		"Fallbacks":      strings.Join(cfg.Fallbacks, ", "),
+		"VPN Upstreams":  vpnUpstreamList(cfg.VPNUpstreams),
+		"Strategy":       cfg.Strategy,
+		"Cache Path":     cfg.CachePath,
+		"Cache Entries":  fmt.Sprintf("%d", cfg.CacheEntries),
+		"Cache Memory":   fmt.Sprintf("%d MB", cfg.CacheMemoryMB),
+		"Serve Stale":    cfg.ServeStale.String(),
+		"Prefetch Hits":  fmt.Sprintf("%d", cfg.PrefetchHits),
+		"Block Lists":    strings.Join(cfg.BlockLists, ", "),
+		"Block Mode":     cfg.BlockMode,
+		"GeoIP Database": geoIPDatabase(cfg.GeoIPDatabase),
+		"VPN Outside":    cfg.VPNOutside,
 	}
 
 	// Calculate max widths
@@ -130,6 +184,29 @@ func showConfig() {
 	fmt.Println(border)
 }
 
+// upstreamList shows the configured upstreams, or the default when none are set
+func upstreamList(upstreams []string) string {
+	if len(upstreams) == 0 {
+		return doh.DefaultUpstream
+	}
+	return strings.Join(upstreams, ", ")
+}
+
+// vpnUpstreamList shows the tunnel resolvers, which are detected from the VPN when none are set
+func vpnUpstreamList(upstreams []string) string {
+	if len(upstreams) == 0 {
+		return "auto (pushed by VPN)"
+	}
+	return strings.Join(upstreams, ", ")
+}
+
+func geoIPDatabase(path string) string {
+	if path == "" {
+		return "auto (" + strings.Join(geoip.DefaultPaths, ", ") + ")"
+	}
+	return path
+}
+
 func handleCheckOpenVPN(enable bool) error {
 	cfg := config.GetConfig()
 	cfg.CheckOpenVPN = enable
@@ -225,6 +302,10 @@ func handleViewLog(parts []string) error {
 				if strings.Contains(line, "[VPN]") {
 					fmt.Println(line)
 				}
+			case "block":
+				if strings.Contains(line, "[BLOCK]") {
+					fmt.Println(line)
+				}
 			}
 		}
 	}
@@ -265,15 +346,21 @@ func handleTest(parts []string) error {
 	}
 	domain := parts[1]
 
-	rules, err := dnsmasq.LoadDomainRules("assets/merged_rule.list")
+	rules, err := dnsmasq.LoadRules("assets/merged_rule.list", config.GetConfig().BlockLists...)
 	if err != nil {
 		return fmt.Errorf("failed to load domain rules: %v", err)
 	}
 
-	if dnsmasq.MatchesRules(domain, rules) {
-		fmt.Printf("🔒 %s ➜ Routed via VPN (matched rule)\n", domain)
-	} else {
+	rule, ok := dnsmasq.NewMatcher(rules, nil, "").Lookup(domain)
+	switch {
+	case !ok:
 		fmt.Printf("🌐 %s ➜ Direct connection (no match)\n", domain)
+	case rule.Policy == ruleset.PolicyVPN:
+		fmt.Printf("🔒 %s ➜ Routed via VPN (%s)\n", domain, rule)
+	case rule.Policy == ruleset.PolicyReject:
+		fmt.Printf("🚫 %s ➜ Rejected (%s)\n", domain, rule)
+	default:
+		fmt.Printf("🌐 %s ➜ Direct connection (%s)\n", domain, rule)
 	}
 	return nil
 }
@@ -284,26 +371,36 @@ func handleRTest(parts []string) error {
 	}
 	domain := parts[1]
 
-	rules, err := dnsmasq.LoadDomainRules("assets/merged_rule.list")
+	rules, err := dnsmasq.LoadRules("assets/merged_rule.list", config.GetConfig().BlockLists...)
 	if err != nil {
 		return fmt.Errorf("failed to load domain rules: %v", err)
 	}
 
-	matched := dnsmasq.MatchesRules(domain, rules)
+	// GEOIP rules need the database; it is only used for this matcher
+	geoDB, err := dnsmasq.LoadGeoIP(config.GetConfig().GeoIPDatabase, config.GetConfig().VPNOutside)
+	if err != nil {
+		return fmt.Errorf("failed to load GeoIP database: %v", err)
+	}
+
 	ipList, err := net.LookupIP(domain)
 	if err != nil || len(ipList) == 0 {
 		return fmt.Errorf("DNS lookup failed: %v", err)
 	}
 
 	ip := ipList[0].String()
+	addr, _ := netip.AddrFromSlice(ipList[0])
+	policy := ruleset.DecideAnswer(dnsmasq.NewMatcher(rules, geoDB, config.GetConfig().VPNOutside), domain, addr)
 	routeIface, err := vpn.GetRouteInterface(ip)
 	if err != nil {
 		return fmt.Errorf("could not determine interface for %s (%s): %v", domain, ip, err)
 	}
 
-	if matched {
+	switch policy {
+	case ruleset.PolicyVPN:
 		fmt.Printf("🔒 %s ➜ Routed via VPN\n", domain)
-	} else {
+	case ruleset.PolicyReject:
+		fmt.Printf("🚫 %s ➜ Rejected\n", domain)
+	default:
 		fmt.Printf("🌐 %s ➜ Direct connection\n", domain)
 	}
 	fmt.Printf("   ➜ Interface: %s (IP: %s)\n", routeIface, ip)
@@ -2,8 +2,11 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
+	"openvpnadvanced/dnsmasq"
+
 	"gopkg.in/ini.v1"
 )
 
@@ -12,6 +15,19 @@ type AppConfig struct {
 	UpdatePeriod  time.Duration
 	CheckOpenVPN  bool
 	LogLevel      string
+	Upstreams     []string
+	Fallbacks     []string
+	VPNUpstreams  []string
+	Strategy      string
+	CachePath     string
+	CacheEntries  int
+	CacheMemoryMB int
+	ServeStale    time.Duration
+	PrefetchHits  int
+	BlockLists    []string
+	BlockMode     string
+	GeoIPDatabase string
+	VPNOutside    string
 }
 
 var appConfig AppConfig
@@ -25,6 +41,19 @@ func LoadINIConfig(path string) error {
 	appConfig.UpdatePeriod = cfg.Section("").Key("update-period").MustDuration(30 * time.Minute)
 	appConfig.CheckOpenVPN = cfg.Section("").Key("check-openvpn").MustBool(true)
 	appConfig.LogLevel = cfg.Section("").Key("log-level").MustString("info")
+	appConfig.Upstreams = cfg.Section("upstream").Key("servers").Strings(",")
+	appConfig.Fallbacks = cfg.Section("upstream").Key("fallback").Strings(",")
+	appConfig.VPNUpstreams = cfg.Section("upstream").Key("vpn").Strings(",")
+	appConfig.Strategy = cfg.Section("upstream").Key("strategy").MustString("sequential")
+	appConfig.CachePath = cfg.Section("cache").Key("path").MustString(dnsmasq.DefaultCachePath)
+	appConfig.CacheEntries = cfg.Section("cache").Key("max-entries").MustInt(dnsmasq.DefaultCacheMaxEntries)
+	appConfig.CacheMemoryMB = cfg.Section("cache").Key("max-memory-mb").MustInt(dnsmasq.DefaultCacheMaxBytes >> 20)
+	appConfig.ServeStale = cfg.Section("cache").Key("serve-stale").MustDuration(dnsmasq.DefaultStaleTTL)
+	appConfig.PrefetchHits = cfg.Section("cache").Key("prefetch-hits").MustInt(dnsmasq.DefaultPrefetchHits)
+	appConfig.BlockLists = cfg.Section("block").Key("lists").Strings(",")
+	appConfig.BlockMode = cfg.Section("block").Key("mode").MustString("nxdomain")
+	appConfig.GeoIPDatabase = cfg.Section("geoip").Key("database").String()
+	appConfig.VPNOutside = strings.ToUpper(cfg.Section("geoip").Key("vpn-outside").String())
 	return nil
 }
 
@@ -34,6 +63,19 @@ func SaveINIConfig(path string) error {
 	cfg.Section("").Key("update-period").SetValue(appConfig.UpdatePeriod.String())
 	cfg.Section("").Key("check-openvpn").SetValue(fmt.Sprintf("%v", appConfig.CheckOpenVPN))
 	cfg.Section("").Key("log-level").SetValue(appConfig.LogLevel)
+	cfg.Section("upstream").Key("servers").SetValue(strings.Join(appConfig.Upstreams, ", "))
+	cfg.Section("upstream").Key("fallback").SetValue(strings.Join(appConfig.Fallbacks, ", "))
+	cfg.Section("upstream").Key("vpn").SetValue(strings.Join(appConfig.VPNUpstreams, ", "))
+	cfg.Section("upstream").Key("strategy").SetValue(appConfig.Strategy)
+	cfg.Section("cache").Key("path").SetValue(appConfig.CachePath)
+	cfg.Section("cache").Key("max-entries").SetValue(fmt.Sprintf("%d", appConfig.CacheEntries))
+	cfg.Section("cache").Key("max-memory-mb").SetValue(fmt.Sprintf("%d", appConfig.CacheMemoryMB))
+	cfg.Section("cache").Key("serve-stale").SetValue(appConfig.ServeStale.String())
+	cfg.Section("cache").Key("prefetch-hits").SetValue(fmt.Sprintf("%d", appConfig.PrefetchHits))
+	cfg.Section("block").Key("lists").SetValue(strings.Join(appConfig.BlockLists, ", "))
+	cfg.Section("block").Key("mode").SetValue(appConfig.BlockMode)
+	cfg.Section("geoip").Key("database").SetValue(appConfig.GeoIPDatabase)
+	cfg.Section("geoip").Key("vpn-outside").SetValue(appConfig.VPNOutside)
 	return cfg.SaveTo(path)
 }
 
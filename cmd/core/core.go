@@ -3,16 +3,27 @@ package core
 import (
 	"fmt"
 	"log"
+	"net"
+	"net/netip"
+	"sync"
 	"time"
 
 	"openvpnadvanced/cmd/config"
 	"openvpnadvanced/dnsmasq"
 	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/doh"
 	"openvpnadvanced/fetcher"
 	"openvpnadvanced/vpn"
 )
 
-var coreStarted bool
+var (
+	coreStarted bool
+	dnsCache    *dnsmasq.Cache
+
+	routesMu     sync.Mutex
+	subnetRoutes []netip.Prefix // installed from IP rules, removed by Shutdown
+	routesIface  string
+)
 
 func RunCoreLogic(verbose bool) error {
 	if coreStarted {
@@ -25,6 +36,14 @@ func RunCoreLogic(verbose bool) error {
 	coreStarted = true
 
 	cfg := config.GetConfig()
+	client, err := doh.NewClient(cfg.Upstreams)
+	if err != nil {
+		return fmt.Errorf("invalid upstream config: %v", err)
+	}
+	if client.Strategy, err = doh.ParseStrategy(cfg.Strategy); err != nil {
+		return fmt.Errorf("invalid upstream config: %v", err)
+	}
+	doh.SetDefaultClient(client)
 
 	if cfg.AutoSubscribe {
 		err := fetcher.FetchAndMergeRules("assets/subscriptions.txt", "assets/merged_rule.list")
@@ -36,21 +55,32 @@ func RunCoreLogic(verbose bool) error {
 		}
 	}
 
-	// Load DNS cache from file
-	rawCache, err := dnsmasq.LoadCacheFromFile()
+	// Load DNS cache from file; a cache is disposable, so start empty if it can't be read
+	cachedEntries, err := dnsmasq.LoadCacheFromFile(cfg.CachePath)
 	if err != nil {
-		return fmt.Errorf("failed to load DNS cache: %v", err)
+		log.Printf("Warning: failed to load DNS cache, starting empty: %v", err)
 	}
-	cache := dnsmasq.NewCacheWithTTL(10 * time.Minute)
-	for domain, record := range rawCache {
-		cache.Set(domain, record.IP)
+	cache := dnsmasq.NewCache()
+	cache.MaxEntries = cfg.CacheEntries
+	cache.MaxBytes = cfg.CacheMemoryMB << 20
+	cache.StaleTTL = cfg.ServeStale
+	cache.PrefetchHits = cfg.PrefetchHits
+	restored := cache.Restore(cachedEntries)
+	log.Printf("Restored %d of %d cached DNS entries", restored, len(cachedEntries))
+	dnsCache = cache
+
+	// Load the GeoIP database that GEOIP rules and vpn-outside match answers against
+	geoDB, err := dnsmasq.LoadGeoIP(cfg.GeoIPDatabase, cfg.VPNOutside)
+	if err != nil {
+		return fmt.Errorf("failed to load GeoIP database: %v", err)
 	}
 
 	// Load routing rules
-	rules, err := dnsmasq.LoadDomainRules("assets/merged_rule.list")
+	rules, err := dnsmasq.LoadRules("assets/merged_rule.list", cfg.BlockLists...)
 	if err != nil {
 		return fmt.Errorf("failed to load rule list: %v", err)
 	}
+	dnsmasq.WarnGeoIPRules(rules, geoDB)
 
 	// Check if VPN is up and get interface
 	if cfg.CheckOpenVPN && !vpn.IsTunnelblickRunning() {
@@ -80,14 +110,33 @@ func RunCoreLogic(verbose bool) error {
 		fmt.Printf("🧠 Loaded %d domain rules\n", len(rules))
 		fmt.Println("🚦 Starting DNS proxy server...")
 	}
-	dnsServer := dnsproxy.NewServer(rules, cache, "127.0.0.1:53", iface)
+	dnsServer, err := dnsproxy.NewServer(rules, cache, cfg.Fallbacks, iface)
+	if err != nil {
+		return fmt.Errorf("invalid fallback config: %v", err)
+	}
+	dnsServer.Upstream = client
+	dnsServer.Matcher = dnsmasq.NewMatcher(rules, geoDB, cfg.VPNOutside)
+	if dnsServer.BlockMode, err = dnsproxy.ParseBlockMode(cfg.BlockMode); err != nil {
+		return fmt.Errorf("invalid block config: %v", err)
+	}
+	if dnsServer.VPNUpstream, err = newVPNUpstream(cfg, client.Strategy, iface); err != nil {
+		return fmt.Errorf("invalid VPN upstream config: %v", err)
+	}
+
+	// Traffic to raw addresses never triggers a DNS lookup, so route the networks of IP rules up front
+	if n := installSubnetRoutes(dnsServer.Matcher.Routes(), iface); n > 0 && verbose {
+		fmt.Printf("✅ Routed %d networks via %s\n", n, iface)
+	}
 	dnsServer.Start()
 
-	// Periodically save cache to disk
+	// Periodically drop expired entries and save cache to disk
 	go func() {
 		for {
 			time.Sleep(30 * time.Second)
-			if err := dnsmasq.SaveCacheToFile(cache); err != nil {
+			if n := cache.Cleanup(); n > 0 {
+				log.Printf("Removed %d expired cache entries", n)
+			}
+			if err := dnsmasq.SaveCacheToFile(cache, cfg.CachePath); err != nil {
 				log.Printf("Failed to save cache: %v", err)
 			}
 		}
@@ -96,6 +145,92 @@ func RunCoreLogic(verbose bool) error {
 	return nil
 }
 
+// newVPNUpstream builds the resolver used for VPN-bound domains, falling back to the
+// DNS servers pushed by the VPN when none are configured. Returns nil if there is none.
+func newVPNUpstream(cfg config.AppConfig, strategy doh.Strategy, iface string) (*doh.Client, error) {
+	specs := cfg.VPNUpstreams
+	if len(specs) == 0 {
+		pushed, err := vpn.FindVPNDNSServers(iface)
+		if err != nil {
+			log.Printf("No VPN DNS server found, VPN domains use the default upstream: %v", err)
+			return nil, nil
+		}
+		specs = pushed
+	}
+
+	client, err := doh.NewClient(specs)
+	if err != nil {
+		return nil, err
+	}
+	client.Strategy = strategy
+
+	// The catch-all VPN routes are gone, so make sure the tunnel resolvers are reached through the tunnel
+	for _, u := range client.Upstreams {
+		plain, ok := u.(*doh.PlainUpstream)
+		if !ok {
+			continue
+		}
+		host, _, err := net.SplitHostPort(plain.Addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		addRoute := vpn.AddRoute
+		if ip.To4() == nil {
+			addRoute = vpn.AddIPv6Route
+		}
+		if err := addRoute(host, iface); err != nil {
+			log.Printf("Warning: failed to route VPN DNS %s via %s: %v", host, iface, err)
+		}
+	}
+
+	log.Printf("VPN domains resolve through: %v", specs)
+	return client, nil
+}
+
+// installSubnetRoutes routes each network through iface and remembers it for Shutdown
+func installSubnetRoutes(prefixes []netip.Prefix, iface string) int {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
+	routesIface = iface
+	for _, prefix := range prefixes {
+		if err := vpn.AddSubnetRoute(prefix, iface); err != nil {
+			log.Printf("Warning: failed to route %s via %s: %v", prefix, iface, err)
+			continue
+		}
+		subnetRoutes = append(subnetRoutes, prefix)
+	}
+	if len(subnetRoutes) > 0 {
+		log.Printf("Routed %d of %d IP rule networks via %s", len(subnetRoutes), len(prefixes), iface)
+	}
+	return len(subnetRoutes)
+}
+
+// Shutdown removes the subnet routes installed by RunCoreLogic. It is safe to call more than once.
+func Shutdown() {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
+	for _, prefix := range subnetRoutes {
+		if err := vpn.DeleteSubnetRoute(prefix, routesIface); err != nil {
+			log.Printf("Warning: failed to remove route %s via %s: %v", prefix, routesIface, err)
+		}
+	}
+	if len(subnetRoutes) > 0 {
+		log.Printf("Removed %d IP rule routes", len(subnetRoutes))
+	}
+	subnetRoutes = nil
+}
+
 func IsCoreStarted() bool {
 	return coreStarted
 }
+
+// Cache returns the DNS cache of the running core, or nil before it starts
+func Cache() *dnsmasq.Cache {
+	return dnsCache
+}
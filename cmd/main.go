@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"openvpnadvanced/cmd/cli"
 	"openvpnadvanced/cmd/config"
+	"openvpnadvanced/cmd/core"
 	"openvpnadvanced/cmd/logger"
 )
 
@@ -28,11 +31,22 @@ func main() {
 	}
 
 	if len(os.Args) > 1 && os.Args[1] == "--start" {
+		// Remove the routes installed at startup however the console ends
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			<-signals
+			core.Shutdown()
+			// os.Exit 不会执行 defer，先关闭日志
+			logger.Close()
+			os.Exit(0)
+		}()
+
 		cli.StartConsole()
+		core.Shutdown()
 	} else {
 		fmt.Println(`Usage:
   sudo ./openvpnadvanced --start     Launch interactive console
   sudo ./openvpnadvanced             Show this help message`)
-		os.Exit(0)
 	}
 }
@@ -1,60 +1,540 @@
 package dnsmasq
 
 import (
+	"container/list"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
+// maxCNAMEHops bounds how far Get follows cached CNAMEs to assemble an answer
+const maxCNAMEHops = 8
+
+// DNSRecord is an entry of the version 1 cache.json, which kept one IP or CNAME target per domain
 type DNSRecord struct {
 	IP        string    `json:"ip"`
 	Timestamp time.Time `json:"timestamp"`
 }
 
+// CacheEntry is the response cached for one (name, qtype) pair. Negative entries
+// (NXDOMAIN, or NOERROR without data) keep the SOA from the authority section.
+type CacheEntry struct {
+	Name   string
+	Qtype  uint16
+	Rcode  int
+	Answer []dns.RR // as received, TTLs relative to Stored
+	Ns     []dns.RR
+	Stored time.Time
+
+	size       int       // approximate memory footprint, maintained by Cache
+	hits       int       // lookups answered from this entry, carried over when it is refreshed
+	refreshing time.Time // when a background refresh was last handed out
+}
+
+// Negative reports whether the entry records that the name or the data does not exist
+func (e *CacheEntry) Negative() bool {
+	if e.Rcode == dns.RcodeNameError {
+		return true
+	}
+	for _, rr := range e.Answer {
+		if rr.Header().Rrtype == e.Qtype {
+			return false
+		}
+	}
+	return true
+}
+
+// TTL is the lifetime of the entry: the smallest TTL in the answer, and for negative
+// entries no more than the SOA negative TTL (RFC 2308 section 5)
+func (e *CacheEntry) TTL() time.Duration {
+	var ttl uint32
+	found := false
+	lower := func(v uint32) {
+		if !found || v < ttl {
+			ttl, found = v, true
+		}
+	}
+
+	for _, rr := range e.Answer {
+		lower(rr.Header().Ttl)
+	}
+	if e.Negative() {
+		soa := findSOA(e.Ns)
+		if soa == nil {
+			return 0
+		}
+		lower(soa.Hdr.Ttl)
+		lower(soa.Minttl)
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// Expired reports whether the entry has outlived its TTL at now
+func (e *CacheEntry) Expired(now time.Time) bool {
+	return now.Sub(e.Stored) >= e.TTL()
+}
+
+// remaining is how long the entry stays fresh at now; negative once it has expired
+func (e *CacheEntry) remaining(now time.Time) time.Duration {
+	return e.TTL() - now.Sub(e.Stored)
+}
+
+// aged returns a copy of the entry whose records have TTLs decremented by its age at now
+func (e *CacheEntry) aged(now time.Time) CacheEntry {
+	age := uint32(now.Sub(e.Stored) / time.Second)
+	cp := *e
+	cp.Answer = decrementTTL(e.Answer, age)
+	cp.Ns = decrementTTL(e.Ns, age)
+	return cp
+}
+
+// stale returns a copy of the entry with every TTL set to ttl, for answers served after expiry
+func (e *CacheEntry) stale(ttl uint32) CacheEntry {
+	cp := *e
+	cp.Answer = decrementTTL(e.Answer, 0)
+	cp.Ns = decrementTTL(e.Ns, 0)
+	for _, rr := range append(append([]dns.RR{}, cp.Answer...), cp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Minttl = ttl
+		}
+		rr.Header().Ttl = ttl
+	}
+	return cp
+}
+
+func decrementTTL(rrs []dns.RR, age uint32) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		cp := dns.Copy(rr)
+		if soa, ok := cp.(*dns.SOA); ok {
+			soa.Minttl = ageTTL(soa.Minttl, age)
+		}
+		cp.Header().Ttl = ageTTL(cp.Header().Ttl, age)
+		out = append(out, cp)
+	}
+	return out
+}
+
+func ageTTL(ttl, age uint32) uint32 {
+	if ttl > age {
+		return ttl - age
+	}
+	return 0
+}
+
+func findSOA(ns []dns.RR) *dns.SOA {
+	for _, rr := range ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+// nxdomainType keys the name-wide NXDOMAIN entry that answers queries of every type
+const nxdomainType = dns.TypeNone
+
+func newCacheKey(name string, qtype uint16) cacheKey {
+	return cacheKey{name: strings.ToLower(dns.Fqdn(name)), qtype: qtype}
+}
+
+func (k cacheKey) String() string {
+	return k.name + "/" + strconv.Itoa(int(k.qtype))
+}
+
+// Default cache bounds, overridable through the [cache] section of config.ini
+const (
+	DefaultCacheMaxEntries = 10000
+	DefaultCacheMaxBytes   = 16 << 20
+	DefaultStaleTTL        = 24 * time.Hour
+	DefaultPrefetchHits    = 3
+)
+
+const (
+	// staleAnswerTTL is the TTL of records served after expiry (RFC 8767 section 4)
+	staleAnswerTTL = 30
+	// prefetchWindow is the fraction of its TTL an entry has left when hot entries are refreshed
+	prefetchWindow = 10
+	// refreshRetry keeps a failed background refresh from being handed out again right away
+	refreshRetry = 10 * time.Second
+)
+
+// Cache holds DNS responses keyed by (name, qtype). Each entry lives as long as the
+// smallest TTL in its answer, and CNAMEs are cached as their own RRsets so chains
+// can be assembled from parts learned by different queries. The cache is bounded by
+// entry count and approximate memory use, evicting the least recently used entries.
 type Cache struct {
-	data map[string]DNSRecord
-	mu   sync.RWMutex
-	ttl  time.Duration
+	data  map[cacheKey]*list.Element // values are *CacheEntry
+	lru   *list.List                 // most recently used at the front
+	bytes int
+	stats CacheStats
+	mu    sync.Mutex
+
+	MinTTL     time.Duration // answers are kept at least this long
+	MaxTTL     time.Duration // and never longer than this
+	MaxEntries int           // 0 means unbounded
+	MaxBytes   int           // approximate memory limit, 0 means unbounded
+
+	StaleTTL     time.Duration // expired entries are served stale for this long, 0 disables serve-stale
+	PrefetchHits int           // entries looked up this often are refreshed before expiry, 0 disables prefetch
+}
+
+// CacheLookup is an entry returned by Lookup along with what the caller should do with it
+type CacheLookup struct {
+	Entry   CacheEntry
+	Stale   bool // the entry has expired and is served with a short TTL (RFC 8767)
+	Refresh bool // the caller should resolve the name again in the background
 }
 
-func NewCacheWithTTL(ttl time.Duration) *Cache {
+// CacheStats are the cache counters shown by the console
+type CacheStats struct {
+	Entries    int
+	Bytes      int
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64 // entries dropped to stay within the size limits
+	Expired    uint64 // entries removed by Cleanup
+	Stale      uint64 // answers served from expired entries
+	Prefetches uint64 // refreshes handed out ahead of expiry
+}
+
+func NewCache() *Cache {
 	return &Cache{
-		data: make(map[string]DNSRecord),
-		ttl:  ttl,
+		data:         make(map[cacheKey]*list.Element),
+		lru:          list.New(),
+		MaxTTL:       24 * time.Hour,
+		MaxEntries:   DefaultCacheMaxEntries,
+		MaxBytes:     DefaultCacheMaxBytes,
+		StaleTTL:     DefaultStaleTTL,
+		PrefetchHits: DefaultPrefetchHits,
+	}
+}
+
+// Get returns the cached response for name and qtype with TTLs decremented by age,
+// following cached CNAMEs when there is no direct entry.
+func (c *Cache) Get(name string, qtype uint16) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.lookup(name, qtype, time.Now())
+	if ok {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
 	}
+	return entry, ok
 }
 
-func (c *Cache) Get(domain string) (string, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// Lookup is Get that also serves expired entries within StaleTTL, and asks the caller
+// to refresh stale entries and popular entries that are about to expire
+func (c *Cache) Lookup(name string, qtype uint16) (CacheLookup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	record, ok := c.data[domain]
+	now := time.Now()
+	e, ok := c.direct(name, qtype, now)
 	if !ok {
-		return "", false
+		entry, ok := c.lookup(name, qtype, now)
+		if ok {
+			c.stats.Hits++
+		} else {
+			c.stats.Misses++
+		}
+		return CacheLookup{Entry: entry}, ok
+	}
+
+	c.stats.Hits++
+	e.hits++
+	due := now.Sub(e.refreshing) >= refreshRetry
+
+	if e.Expired(now) {
+		c.stats.Stale++
+		if due {
+			e.refreshing = now
+		}
+		return CacheLookup{Entry: e.stale(staleAnswerTTL), Stale: true, Refresh: due}, true
+	}
+
+	hot := c.PrefetchHits > 0 && e.hits >= c.PrefetchHits
+	if hot && due && e.remaining(now)*prefetchWindow <= e.TTL() {
+		c.stats.Prefetches++
+		e.refreshing = now
+		return CacheLookup{Entry: e.aged(now), Refresh: true}, true
+	}
+	return CacheLookup{Entry: e.aged(now)}, true
+}
+
+// direct returns the entry stored for name and qtype, or the name-wide NXDOMAIN entry,
+// as long as it is fresh or may still be served stale
+func (c *Cache) direct(name string, qtype uint16, now time.Time) (*CacheEntry, bool) {
+	for _, t := range []uint16{qtype, nxdomainType} {
+		el, ok := c.data[newCacheKey(name, t)]
+		if !ok {
+			continue
+		}
+		e := el.Value.(*CacheEntry)
+		if !c.dead(e, now) {
+			c.lru.MoveToFront(el)
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// dead reports whether an entry can no longer be served, not even stale
+func (c *Cache) dead(e *CacheEntry, now time.Time) bool {
+	return e.remaining(now) <= -c.StaleTTL
+}
+
+func (c *Cache) lookup(name string, qtype uint16, now time.Time) (CacheEntry, bool) {
+	if e, ok := c.live(name, qtype, now); ok {
+		return e.aged(now), true
+	}
+	if qtype == dns.TypeCNAME {
+		return CacheEntry{}, false
+	}
+
+	var chain []dns.RR
+	current := name
+	for hops := 0; hops < maxCNAMEHops; hops++ {
+		e, ok := c.live(current, dns.TypeCNAME, now)
+		if !ok || e.Negative() {
+			return CacheEntry{}, false
+		}
+		// 条目来自磁盘或上游，内容不可信：不是 CNAME 时按未命中处理
+		var cname *dns.CNAME
+		if len(e.Answer) > 0 {
+			cname, _ = e.Answer[0].(*dns.CNAME)
+		}
+		if cname == nil {
+			return CacheEntry{}, false
+		}
+		chain = append(chain, e.aged(now).Answer...)
+		current = cname.Target
+
+		if e, ok := c.live(current, qtype, now); ok {
+			found := e.aged(now)
+			found.Name, found.Qtype = dns.Fqdn(name), qtype
+			found.Answer = append(chain, found.Answer...)
+			return found, true
+		}
+	}
+	return CacheEntry{}, false
+}
+
+// live returns the unexpired entry for name and qtype, or the name-wide NXDOMAIN entry,
+// and marks it as recently used
+func (c *Cache) live(name string, qtype uint16, now time.Time) (*CacheEntry, bool) {
+	for _, t := range []uint16{qtype, nxdomainType} {
+		el, ok := c.data[newCacheKey(name, t)]
+		if !ok {
+			continue
+		}
+		e := el.Value.(*CacheEntry)
+		if !e.Expired(now) {
+			c.lru.MoveToFront(el)
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Set caches the answer to a (name, qtype) query. The CNAMEs and the final RRset
+// in the answer are also cached under their own owner names.
+func (c *Cache) Set(name string, qtype uint16, answer []dns.RR) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.store(&CacheEntry{Name: name, Qtype: qtype, Rcode: dns.RcodeSuccess, Answer: answer, Stored: now})
+	c.storeParts(name, qtype, answer, now)
+	c.evict()
+}
+
+// SetNegative caches an NXDOMAIN or NODATA response. answer holds any CNAME chain
+// that led to the missing name and ns the authority section carrying the SOA.
+func (c *Cache) SetNegative(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.store(&CacheEntry{Name: name, Qtype: qtype, Rcode: rcode, Answer: answer, Ns: ns, Stored: now})
+	c.storeParts(name, qtype, answer, now)
+
+	// Without a CNAME in between, NXDOMAIN means the name has no records of any type
+	if rcode == dns.RcodeNameError && len(answer) == 0 {
+		c.store(&CacheEntry{Name: name, Qtype: nxdomainType, Rcode: rcode, Ns: ns, Stored: now})
+	}
+	c.evict()
+}
+
+// Restore bulk-loads persisted entries, keeping the time each was stored so TTLs keep
+// counting down from when the answer was received. Entries that have already expired are
+// dropped. It returns the number of entries restored.
+func (c *Cache) Restore(entries []CacheEntry) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	restored := 0
+	for _, entry := range entries {
+		e := entry
+		if e.Stored.IsZero() || e.Stored.After(now) || e.Expired(now) {
+			continue
+		}
+		e.hits, e.refreshing = 0, time.Time{}
+		c.store(&e)
+		restored++
+	}
+	c.evict()
+	return restored
+}
+
+// storeParts caches each RRset of an answer under its own owner name and type
+func (c *Cache) storeParts(name string, qtype uint16, answer []dns.RR, now time.Time) {
+	parts := make(map[cacheKey][]dns.RR)
+	for _, rr := range answer {
+		key := newCacheKey(rr.Header().Name, rr.Header().Rrtype)
+		parts[key] = append(parts[key], rr)
+	}
+	for key, rrs := range parts {
+		if key != newCacheKey(name, qtype) {
+			c.store(&CacheEntry{Name: key.name, Qtype: key.qtype, Rcode: dns.RcodeSuccess, Answer: rrs, Stored: now})
+		}
+	}
+}
+
+func (c *Cache) store(e *CacheEntry) {
+	e.Name = dns.Fqdn(e.Name)
+	e.Answer = c.clamp(e.Answer)
+	e.Ns = c.clamp(e.Ns)
+	if e.TTL() <= 0 {
+		return
 	}
-	if time.Since(record.Timestamp) > c.ttl {
-		// expired
-		return "", false
+	e.size = entrySize(e)
+
+	key := newCacheKey(e.Name, e.Qtype)
+	if el, ok := c.data[key]; ok {
+		old := el.Value.(*CacheEntry)
+		c.bytes -= old.size
+		e.hits = old.hits
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.data[key] = c.lru.PushFront(e)
+	}
+	c.bytes += e.size
+}
+
+// evict drops least recently used entries until the cache is within its limits
+func (c *Cache) evict() {
+	for c.lru.Len() > 0 && c.overLimit() {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
 	}
-	return record.IP, true
 }
 
-func (c *Cache) Set(domain, ip string) {
+func (c *Cache) overLimit() bool {
+	return (c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries) ||
+		(c.MaxBytes > 0 && c.bytes > c.MaxBytes)
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*CacheEntry)
+	delete(c.data, newCacheKey(e.Name, e.Qtype))
+	c.bytes -= e.size
+}
+
+// Cleanup removes entries that can no longer be served, not even stale, and returns how many were dropped
+func (c *Cache) Cleanup() int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.data[domain] = DNSRecord{
-		IP:        ip,
-		Timestamp: time.Now(),
+	now := time.Now()
+	removed := 0
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if c.dead(el.Value.(*CacheEntry), now) {
+			c.remove(el)
+			removed++
+		}
+		el = prev
 	}
+	c.stats.Expired += uint64(removed)
+	return removed
 }
 
-func (c *Cache) Raw() map[string]DNSRecord {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// Stats returns a snapshot of the cache counters
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.bytes
+	return stats
+}
 
-	copied := make(map[string]DNSRecord)
-	for k, v := range c.data {
-		copied[k] = v
+// entrySize approximates the memory held by an entry: wire size of its records plus bookkeeping
+func entrySize(e *CacheEntry) int {
+	size := 128 + len(e.Name)
+	for _, rr := range e.Answer {
+		size += 64 + dns.Len(rr)
 	}
-	return copied
+	for _, rr := range e.Ns {
+		size += 64 + dns.Len(rr)
+	}
+	return size
+}
+
+// clamp copies the records with TTLs bounded by MinTTL and MaxTTL
+func (c *Cache) clamp(rrs []dns.RR) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	minTTL := uint32(c.MinTTL / time.Second)
+	maxTTL := uint32(c.MaxTTL / time.Second)
+
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		cp := dns.Copy(rr)
+		if cp.Header().Ttl < minTTL {
+			cp.Header().Ttl = minTTL
+		}
+		if maxTTL > 0 && cp.Header().Ttl > maxTTL {
+			cp.Header().Ttl = maxTTL
+		}
+		out = append(out, cp)
+	}
+	return out
+}
+
+// Entries returns a snapshot of every cached entry
+func (c *Cache) Entries() []CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]CacheEntry, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		entries = append(entries, *el.Value.(*CacheEntry))
+	}
+	return entries
+}
+
+// Len returns the number of cached entries, including expired ones not yet cleaned up
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
 }
@@ -0,0 +1,254 @@
+package dnsmasq_test
+
+import (
+	"fmt"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func mustRR(line string) dns.RR {
+	rr, err := dns.NewRR(line)
+	Expect(err).NotTo(HaveOccurred())
+	return rr
+}
+
+var _ = Describe("Cache", func() {
+	var cache *dnsmasq.Cache
+
+	BeforeEach(func() {
+		cache = dnsmasq.NewCache()
+	})
+
+	It("keeps the full RRset per name and type", func() {
+		cache.Set("example.com", dns.TypeA, []dns.RR{
+			mustRR("example.com. 300 IN A 192.0.2.1"),
+			mustRR("example.com. 300 IN A 192.0.2.2"),
+		})
+
+		entry, ok := cache.Get("EXAMPLE.com.", dns.TypeA)
+		Expect(ok).To(BeTrue())
+		Expect(entry.Answer).To(HaveLen(2))
+
+		_, ok = cache.Get("example.com", dns.TypeAAAA)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("expires an entry with its smallest TTL", func() {
+		cache.Set("short.example.com", dns.TypeA, []dns.RR{
+			mustRR("short.example.com. 1 IN A 192.0.2.1"),
+			mustRR("short.example.com. 300 IN A 192.0.2.2"),
+		})
+
+		_, ok := cache.Get("short.example.com", dns.TypeA)
+		Expect(ok).To(BeTrue())
+		Eventually(func() bool {
+			_, ok := cache.Get("short.example.com", dns.TypeA)
+			return ok
+		}, 2*time.Second, 100*time.Millisecond).Should(BeFalse())
+	})
+
+	It("decrements TTLs by the entry's age", func() {
+		cache.Set("example.com", dns.TypeA, []dns.RR{mustRR("example.com. 300 IN A 192.0.2.1")})
+
+		time.Sleep(1100 * time.Millisecond)
+		entry, ok := cache.Get("example.com", dns.TypeA)
+		Expect(ok).To(BeTrue())
+		Expect(entry.Answer[0].Header().Ttl).To(BeNumerically("<", 300))
+	})
+
+	It("stores CNAMEs explicitly and assembles chains from them", func() {
+		cache.Set("www.example.com", dns.TypeA, []dns.RR{
+			mustRR("www.example.com. 300 IN CNAME edge.example.net."),
+			mustRR("edge.example.net. 60 IN A 192.0.2.9"),
+		})
+
+		cname, ok := cache.Get("www.example.com", dns.TypeCNAME)
+		Expect(ok).To(BeTrue())
+		Expect(cname.Answer[0].(*dns.CNAME).Target).To(Equal("edge.example.net."))
+
+		cache.Set("img.example.com", dns.TypeCNAME, []dns.RR{
+			mustRR("img.example.com. 300 IN CNAME edge.example.net."),
+		})
+		entry, ok := cache.Get("img.example.com", dns.TypeA)
+		Expect(ok).To(BeTrue())
+		Expect(entry.Answer).To(HaveLen(2))
+		Expect(entry.Answer[1].(*dns.A).A.String()).To(Equal("192.0.2.9"))
+	})
+
+	Describe("negative caching", func() {
+		soa := func(ttl, minttl int) dns.RR {
+			rr := mustRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 86400").(*dns.SOA)
+			rr.Hdr.Ttl, rr.Minttl = uint32(ttl), uint32(minttl)
+			return rr
+		}
+
+		It("answers every type of an NXDOMAIN name for the SOA minimum", func() {
+			cache.SetNegative("typo.example.com", dns.TypeA, dns.RcodeNameError, nil, []dns.RR{soa(3600, 900)})
+
+			entry, ok := cache.Get("typo.example.com", dns.TypeAAAA)
+			Expect(ok).To(BeTrue())
+			Expect(entry.Rcode).To(Equal(dns.RcodeNameError))
+			Expect(entry.Negative()).To(BeTrue())
+			Expect(entry.TTL()).To(Equal(900 * time.Second))
+			Expect(entry.Ns).To(HaveLen(1))
+		})
+
+		It("keeps NODATA specific to the queried type", func() {
+			cache.SetNegative("v4only.example.com", dns.TypeAAAA, dns.RcodeSuccess, nil, []dns.RR{soa(60, 900)})
+
+			entry, ok := cache.Get("v4only.example.com", dns.TypeAAAA)
+			Expect(ok).To(BeTrue())
+			Expect(entry.Rcode).To(Equal(dns.RcodeSuccess))
+			Expect(entry.TTL()).To(Equal(60 * time.Second))
+
+			_, ok = cache.Get("v4only.example.com", dns.TypeA)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("does not cache negative answers without an SOA", func() {
+			cache.SetNegative("nosoa.example.com", dns.TypeA, dns.RcodeNameError, nil, nil)
+
+			_, ok := cache.Get("nosoa.example.com", dns.TypeA)
+			Expect(ok).To(BeFalse())
+		})
+	})
+	Describe("size limits", func() {
+		setA := func(name, ip string) {
+			cache.Set(name, dns.TypeA, []dns.RR{mustRR(name + ". 300 IN A " + ip)})
+		}
+
+		It("evicts the least recently used entry", func() {
+			cache.MaxEntries = 2
+			setA("a.example.com", "192.0.2.1")
+			setA("b.example.com", "192.0.2.2")
+
+			_, ok := cache.Get("a.example.com", dns.TypeA)
+			Expect(ok).To(BeTrue())
+			setA("c.example.com", "192.0.2.3")
+
+			_, ok = cache.Get("b.example.com", dns.TypeA)
+			Expect(ok).To(BeFalse())
+			_, ok = cache.Get("a.example.com", dns.TypeA)
+			Expect(ok).To(BeTrue())
+
+			stats := cache.Stats()
+			Expect(stats.Entries).To(Equal(2))
+			Expect(stats.Evictions).To(BeEquivalentTo(1))
+			Expect(stats.Hits).To(BeEquivalentTo(2))
+			Expect(stats.Misses).To(BeEquivalentTo(1))
+		})
+
+		It("stays within the memory limit", func() {
+			cache.MaxBytes = 1024
+			for i := 0; i < 50; i++ {
+				setA(fmt.Sprintf("host%d.example.com", i), "192.0.2.1")
+			}
+
+			stats := cache.Stats()
+			Expect(stats.Bytes).To(BeNumerically("<=", 1024))
+			Expect(stats.Entries).To(BeNumerically("<", 50))
+			Expect(stats.Evictions).To(BeEquivalentTo(50 - stats.Entries))
+		})
+
+		It("removes expired entries on cleanup", func() {
+			cache.StaleTTL = 0
+			cache.Set("short.example.com", dns.TypeA, []dns.RR{mustRR("short.example.com. 1 IN A 192.0.2.1")})
+			setA("long.example.com", "192.0.2.2")
+
+			time.Sleep(1100 * time.Millisecond)
+			Expect(cache.Cleanup()).To(Equal(1))
+			Expect(cache.Len()).To(Equal(1))
+			Expect(cache.Stats().Expired).To(BeEquivalentTo(1))
+		})
+	})
+	Describe("serve-stale and prefetch", func() {
+		It("serves an expired entry with a short TTL and asks for one refresh", func() {
+			cache.Set("stale.example.com", dns.TypeA, []dns.RR{mustRR("stale.example.com. 1 IN A 192.0.2.1")})
+			time.Sleep(1100 * time.Millisecond)
+
+			_, ok := cache.Get("stale.example.com", dns.TypeA)
+			Expect(ok).To(BeFalse())
+
+			lookup, ok := cache.Lookup("stale.example.com", dns.TypeA)
+			Expect(ok).To(BeTrue())
+			Expect(lookup.Stale).To(BeTrue())
+			Expect(lookup.Refresh).To(BeTrue())
+			Expect(lookup.Entry.Answer[0].Header().Ttl).To(BeEquivalentTo(30))
+
+			lookup, _ = cache.Lookup("stale.example.com", dns.TypeA)
+			Expect(lookup.Refresh).To(BeFalse())
+			Expect(cache.Stats().Stale).To(BeEquivalentTo(2))
+		})
+
+		It("does not serve stale entries when disabled", func() {
+			cache.StaleTTL = 0
+			cache.Set("stale.example.com", dns.TypeA, []dns.RR{mustRR("stale.example.com. 1 IN A 192.0.2.1")})
+			time.Sleep(1100 * time.Millisecond)
+
+			_, ok := cache.Lookup("stale.example.com", dns.TypeA)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("refreshes popular entries shortly before they expire", func() {
+			cache.PrefetchHits = 2
+			cache.Set("hot.example.com", dns.TypeA, []dns.RR{mustRR("hot.example.com. 1 IN A 192.0.2.1")})
+
+			lookup, _ := cache.Lookup("hot.example.com", dns.TypeA)
+			Expect(lookup.Refresh).To(BeFalse())
+
+			Eventually(func() bool {
+				lookup, _ := cache.Lookup("hot.example.com", dns.TypeA)
+				return lookup.Refresh && !lookup.Stale
+			}, 2*time.Second, 10*time.Millisecond).Should(BeTrue())
+			Expect(cache.Stats().Prefetches).To(BeEquivalentTo(1))
+		})
+	})
+	Describe("Restore", func() {
+		It("keeps the stored time and drops expired entries", func() {
+			restored := cache.Restore([]dnsmasq.CacheEntry{
+				{
+					Name:   "old.example.com.",
+					Qtype:  dns.TypeA,
+					Answer: []dns.RR{mustRR("old.example.com. 300 IN A 192.0.2.1")},
+					Stored: time.Now().Add(-time.Hour),
+				},
+				{
+					Name:   "recent.example.com.",
+					Qtype:  dns.TypeA,
+					Answer: []dns.RR{mustRR("recent.example.com. 300 IN A 192.0.2.2")},
+					Stored: time.Now().Add(-100 * time.Second),
+				},
+			})
+			Expect(restored).To(Equal(1))
+			Expect(cache.Len()).To(Equal(1))
+
+			_, ok := cache.Lookup("old.example.com", dns.TypeA)
+			Expect(ok).To(BeFalse())
+
+			entry, ok := cache.Get("recent.example.com", dns.TypeA)
+			Expect(ok).To(BeTrue())
+			Expect(entry.Answer[0].Header().Ttl).To(BeNumerically("<=", 200))
+		})
+
+		It("treats a CNAME entry that does not start with a CNAME record as a miss", func() {
+			Expect(cache.Restore([]dnsmasq.CacheEntry{{
+				Name:  "bad.example.com.",
+				Qtype: dns.TypeCNAME,
+				Answer: []dns.RR{
+					mustRR("bad.example.com. 300 IN A 192.0.2.3"),
+					mustRR("bad.example.com. 300 IN CNAME edge.example.net."),
+				},
+				Stored: time.Now(),
+			}})).To(Equal(1))
+
+			cache.Set("edge.example.net", dns.TypeA, []dns.RR{mustRR("edge.example.net. 300 IN A 192.0.2.9")})
+			_, ok := cache.Get("bad.example.com", dns.TypeA)
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
@@ -2,13 +2,19 @@ package dnsmasq
 
 import (
 	"fmt"
+	"openvpnadvanced/ruleset"
 	"os"
+
+	"github.com/miekg/dns"
 )
 
 type ResolvedResult struct {
-	Domain      string
-	IP          string
-	ShouldRoute bool
+	Domain string
+	IP     string
+	Policy ruleset.Policy // decided by the first rule matching the domain
+	Rcode  int            // NXDOMAIN/NODATA for negative answers, SERVFAIL when resolution failed
+	Answer []dns.RR       // CNAME chain followed by every address record, with TTLs
+	Ns     []dns.RR       // authority section (SOA) of negative answers
 }
 
 // ExportVPNIPs writes all VPN-targeted domain-IP mappings to a file
@@ -20,7 +26,7 @@ func ExportVPNIPs(results []ResolvedResult, outputPath string) error {
 	defer file.Close()
 
 	for _, res := range results {
-		if res.ShouldRoute && res.IP != "" {
+		if res.Policy == ruleset.PolicyVPN && res.IP != "" {
 			line := fmt.Sprintf("%s %s\n", res.IP, res.Domain)
 			_, err := file.WriteString(line)
 			if err != nil {
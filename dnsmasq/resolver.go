@@ -1,193 +1,338 @@
 package dnsmasq
 
 import (
-	"bufio"
+	"context"
 	"log"
-	"net"
+	"net/netip"
 	"openvpnadvanced/doh"
+	"openvpnadvanced/geoip"
+	"openvpnadvanced/internal/singleflight"
+	"openvpnadvanced/ruleset"
 	"os"
 	"strings"
+
+	"github.com/miekg/dns"
 )
 
-type Rule struct {
-	Suffix string
+// inflight coalesces concurrent upstream resolutions of the same (name, qtype)
+var inflight singleflight.Group[ResolvedResult]
+
+// Rule is a parsed Clash/Surge routing rule
+type Rule = ruleset.Rule
+
+// NewMatcher compiles rules for repeated lookups. GEOIP rules match through db, which may
+// be nil; with outside set to a country code, names that no rule decides are routed through
+// the VPN when their answer lies outside that country.
+func NewMatcher(rules []Rule, db geoip.DB, outside string) *ruleset.Set {
+	set := ruleset.Compile(rules)
+	if db != nil {
+		set.UseGeoIP(db, outside)
+	}
+	return set
 }
 
-func MatchesRules(domain string, rules []Rule) bool {
-	// 将域名转换为小写，确保不受大小写影响
-	domain = strings.ToLower(domain)
+// LoadGeoIP opens the GeoIP database at path, or the first of geoip.DefaultPaths when path
+// is empty. It returns a nil database when none is configured or found, in which case GEOIP
+// rules never match.
+func LoadGeoIP(path, outside string) (geoip.DB, error) {
+	if path == "" {
+		found, err := geoip.Find()
+		if err != nil {
+			if outside != "" {
+				log.Printf("⚠️ No GeoIP database, answers outside %s are not routed via VPN: %v", outside, err)
+			}
+			return nil, nil
+		}
+		path = found
+	}
+
+	db, err := geoip.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded GeoIP database %s", path)
+	if outside != "" {
+		log.Printf("Answers outside %s are routed via VPN", outside)
+	}
+	return db, nil
+}
 
+// WarnGeoIPRules logs the GEOIP rules that can never match because db is nil
+func WarnGeoIPRules(rules []Rule, db geoip.DB) {
+	if db != nil {
+		return
+	}
 	for _, rule := range rules {
-		// 将规则后缀转换为小写进行匹配
-		if strings.HasSuffix(domain, strings.ToLower(rule.Suffix)) {
-			return true
+		if rule.Type == ruleset.TypeGeoIP {
+			log.Printf("⚠️ %s needs a GeoIP database in assets/ and is ignored", rule)
 		}
 	}
-	return false
 }
 
-func ResolveRecursive(domain string, rules []Rule, cache *Cache) (bool, string) {
-	visited := make(map[string]bool)
-	current := domain
-	originalDomain := domain // 保持原始域名
+// MatchesRules reports whether the first rule matching domain routes it through the VPN.
+// Suffixes match on label boundaries, so x.com matches a.x.com but not fox.com.
+//
+// Deprecated: it compiles the rules on every call. Build the matcher once with NewMatcher
+// and pass it to ruleset.Decide.
+func MatchesRules(domain string, rules []Rule) bool {
+	return ruleset.Decide(NewMatcher(rules, nil, ""), domain) == ruleset.PolicyVPN
+}
 
-	for depth := 0; depth < 10; depth++ {
-		if visited[current] {
-			log.Printf("⚠️ Circular CNAME detected for %s", domain)
-			return false, ""
-		}
-		visited[current] = true
-
-		// 缓存检查（保留原始域名规则匹配）
-		if cachedVal, ok := cache.Get(current); ok {
-			if net.ParseIP(cachedVal) != nil {
-				log.Printf("[CACHE] %s ➜ %s", current, cachedVal)
-				return MatchesRules(originalDomain, rules), cachedVal // 使用原始域名进行匹配
-			} else {
-				log.Printf("[CACHE-CNAME] %s ➜ %s", current, cachedVal)
-				current = cachedVal
-				continue
-			}
+// ResolveRecursive resolves domain through client, following CNAMEs, and returns the policy of the first rule
+// matching the domain or its address. With the matcher's outside mode, addresses abroad fall back to VPN.
+func ResolveRecursive(client *doh.Client, domain string, rules ruleset.Matcher, cache *Cache) (ruleset.Policy, string) {
+	policy, ip, _ := ResolveWithCNAME(client, domain, rules, cache)
+	return policy, ip
+}
+
+// ResolveWithCNAME is ResolveRecursive that also returns the first CNAME in the chain
+func ResolveWithCNAME(client *doh.Client, domain string, rules ruleset.Matcher, cache *Cache) (ruleset.Policy, string, string) {
+	result := Resolve(client, domain, dns.TypeA, rules, cache)
+	if result.IP == "" {
+		result = Resolve(client, domain, dns.TypeAAAA, rules, cache)
+	}
+	if result.IP == "" {
+		return result.Policy, "", ""
+	}
+
+	var firstCNAME string
+	for _, rr := range result.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			firstCNAME = strings.TrimSuffix(cname.Target, ".")
+			break
 		}
+	}
+	return result.Policy, result.IP, firstCNAME
+}
 
-		// DNS查询流程
-		ip, cname, err := doh.QueryWithCNAME(current)
-		if err == nil && ip != "" {
-			log.Printf("[A] %s ➜ %s", current, ip)
-			cache.Set(originalDomain, ip) // 使用原始域名缓存
-			cache.Set(current, ip)
-			return MatchesRules(originalDomain, rules), ip
-		}
-
-		ipv6, err := doh.QueryAAAA(current)
-		if err == nil && ipv6 != "" {
-			log.Printf("[AAAA] %s ➜ %s", current, ipv6)
-			cache.Set(originalDomain, ipv6) // 使用原始域名缓存
-			cache.Set(current, ipv6)
-			return MatchesRules(originalDomain, rules), ipv6
-		}
-
-		if cname != "" {
-			log.Printf("[CNAME] %s ➜ %s", current, cname)
-			current = cname
-			continue
-		}
-
-		// 后备查询逻辑
-		allRecords, err := doh.QueryAll(current)
-		if err == nil {
-			for recordType, answers := range allRecords {
-				for _, answer := range answers {
-					if net.ParseIP(answer) != nil {
-						log.Printf("[FALLBACK][%s] %s ➜ %s", recordType, current, answer)
-						cache.Set(originalDomain, answer) // 使用原始域名缓存
-						cache.Set(current, answer)
-						return MatchesRules(originalDomain, rules), answer
-					}
-				}
-			}
+// Resolve looks up an A or AAAA query and returns the full CNAME chain and address set with upstream TTLs.
+// NXDOMAIN and NODATA responses are cached and reported through Rcode; SERVFAIL means resolution failed.
+// Expired entries are answered stale and, like popular entries close to expiry, refreshed in the background.
+func Resolve(client *doh.Client, domain string, qtype uint16, rules ruleset.Matcher, cache *Cache) ResolvedResult {
+	// 缓存检查：命中时 TTL 已按剩余时间递减
+	if lookup, ok := cache.Lookup(domain, qtype); ok {
+		entry := lookup.Entry
+		result := ResolvedResult{
+			Domain: domain,
+			Rcode:  entry.Rcode,
+			Answer: entry.Answer,
+			Ns:     entry.Ns,
+			IP:     firstAddress(entry.Answer, qtype),
+		}
+		result.Policy = decide(rules, domain, result.IP)
+		switch {
+		case lookup.Stale:
+			log.Printf("[CACHE-STALE] %s %s ➜ %s", domain, dns.TypeToString[qtype], result.IP)
+		case entry.Negative():
+			log.Printf("[CACHE-NEG] %s %s ➜ %s", domain, dns.TypeToString[qtype], negativeKind(entry.Rcode))
+		default:
+			log.Printf("[CACHE] %s ➜ %s (%d records)", domain, result.IP, len(entry.Answer))
 		}
 
-		break
+		// 过期或即将过期的热点条目在后台刷新，客户端无需等待
+		if lookup.Refresh {
+			go refresh(client, domain, qtype, rules, cache)
+		}
+		return result
 	}
 
-	log.Printf("❌ Resolution failed for %s", domain)
-	return false, ""
+	return resolveShared(client, domain, qtype, rules, cache)
 }
 
-func LoadDomainRules(path string) ([]Rule, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// resolveShared is resolveUpstream shared by every concurrent caller asking for the same name and type
+func resolveShared(client *doh.Client, domain string, qtype uint16, rules ruleset.Matcher, cache *Cache) ResolvedResult {
+	result, _, shared := inflight.Do(newCacheKey(domain, qtype).String(), func() (ResolvedResult, error) {
+		return resolveUpstream(client, domain, qtype, rules, cache), nil
+	})
+	if shared {
+		// 复用同一次上游解析的结果，但保留调用方自己的域名写法
+		log.Printf("[SHARED] %s %s", domain, dns.TypeToString[qtype])
+		result.Domain = domain
+		result.Answer = append([]dns.RR(nil), result.Answer...)
+		result.Ns = append([]dns.RR(nil), result.Ns...)
 	}
-	defer file.Close()
+	return result
+}
 
-	var rules []Rule
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		if strings.HasPrefix(line, "DOMAIN-SUFFIX,") {
-			parts := strings.SplitN(line, ",", 2)
-			if len(parts) == 2 {
-				rules = append(rules, Rule{Suffix: strings.ToLower(parts[1])})
-			}
-		}
+// refresh resolves a cached name again so the next lookup finds a fresh entry
+func refresh(client *doh.Client, domain string, qtype uint16, rules ruleset.Matcher, cache *Cache) {
+	log.Printf("[PREFETCH] %s %s", domain, dns.TypeToString[qtype])
+	if result := resolveShared(client, domain, qtype, rules, cache); result.Rcode == dns.RcodeServerFailure {
+		log.Printf("⚠️ Background refresh failed for %s, keeping the cached answer", domain)
 	}
-	return rules, nil
 }
 
-func ResolveWithCNAME(domain string, rules []Rule, cache *Cache) (bool, string, string) {
+// resolveUpstream resolves a query through client, bypassing the cache, and caches the outcome
+func resolveUpstream(client *doh.Client, domain string, qtype uint16, rules ruleset.Matcher, cache *Cache) ResolvedResult {
+	result := ResolvedResult{
+		Domain: domain,
+		Policy: ruleset.Decide(rules, domain), // 使用原始域名进行匹配，首个命中的规则生效
+	}
+
 	visited := make(map[string]bool)
-	current := domain
-	originalDomain := domain
-	var firstCNAME string
+	current := dns.Fqdn(domain)
 
 	for depth := 0; depth < 10; depth++ {
-		if visited[current] {
+		if visited[strings.ToLower(current)] {
 			log.Printf("⚠️ Circular CNAME detected for %s", domain)
-			return false, "", ""
-		}
-		visited[current] = true
-
-		// 缓存检查（保持规则匹配）
-		if cachedVal, ok := cache.Get(current); ok {
-			if net.ParseIP(cachedVal) != nil {
-				log.Printf("[CACHE] %s ➜ %s", current, cachedVal)
-				return MatchesRules(originalDomain, rules), cachedVal, firstCNAME
-			} else {
-				log.Printf("[CACHE-CNAME] %s ➜ %s", current, cachedVal)
-				current = cachedVal
-				continue
-			}
+			break
 		}
+		visited[strings.ToLower(current)] = true
 
-		// DNS查询流程
-		ip, cname, err := doh.QueryWithCNAME(current)
-		if err == nil && ip != "" {
-			log.Printf("[A] %s ➜ %s", current, ip)
-			cache.Set(originalDomain, ip) // 使用原始域名缓存
-			cache.Set(current, ip)
-			return MatchesRules(originalDomain, rules), ip, firstCNAME
+		m := new(dns.Msg)
+		m.SetQuestion(current, qtype)
+		resp, err := client.Exchange(context.Background(), m)
+		if err != nil {
+			log.Printf("⚠️ Lookup failed for %s: %v", current, err)
+			break
 		}
+		result.Answer = append(result.Answer, resp.Answer...)
 
-		ipv6, err := doh.QueryAAAA(current)
-		if err == nil && ipv6 != "" {
-			log.Printf("[AAAA] %s ➜ %s", current, ipv6)
-			cache.Set(originalDomain, ipv6) // 使用原始域名缓存
-			cache.Set(current, ipv6)
-			return MatchesRules(originalDomain, rules), ipv6, firstCNAME
+		// 上游通常一次返回完整的 CNAME 链；沿链找到最终名称
+		target := followCNAMEs(current, resp.Answer)
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, target) {
+				result.IP = addressOf(rr)
+				break
+			}
+		}
+		if result.IP != "" {
+			result.Policy = decide(rules, domain, result.IP)
+			log.Printf("[%s] %s ➜ %s (%d records)", dns.TypeToString[qtype], domain, result.IP, len(result.Answer))
+			cache.Set(domain, qtype, result.Answer)
+			return result
 		}
 
-		if cname != "" {
-			log.Printf("[CNAME] %s ➜ %s", current, cname)
-			if firstCNAME == "" {
-				firstCNAME = cname
-			}
-			current = cname
-			continue
-		}
-
-		// 后备查询逻辑
-		allRecords, err := doh.QueryAll(current)
-		if err == nil {
-			for recordType, answers := range allRecords {
-				for _, answer := range answers {
-					if net.ParseIP(answer) != nil {
-						log.Printf("[FALLBACK][%s] %s ➜ %s", recordType, current, answer)
-						cache.Set(originalDomain, answer) // 使用原始域名缓存
-						cache.Set(current, answer)
-						return MatchesRules(originalDomain, rules), answer, firstCNAME
-					}
-				}
-			}
+		// 否定应答（RFC 2308）：域名不存在，或存在但没有该类型记录
+		if resp.Rcode == dns.RcodeNameError || (resp.Rcode == dns.RcodeSuccess && strings.EqualFold(target, current)) {
+			result.Rcode = resp.Rcode
+			result.Ns = resp.Ns
+			log.Printf("[%s] %s %s", negativeKind(resp.Rcode), domain, dns.TypeToString[qtype])
+			cache.SetNegative(domain, qtype, resp.Rcode, result.Answer, resp.Ns)
+			return result
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			log.Printf("⚠️ Lookup for %s answered %s", current, dns.RcodeToString[resp.Rcode])
+			break
 		}
 
-		break
+		// 链条在上游止于 CNAME，继续解析目标
+		log.Printf("[CNAME] %s ➜ %s", current, target)
+		current = target
 	}
 
 	log.Printf("❌ Resolution failed for %s", domain)
-	return false, "", ""
+	result.Rcode = dns.RcodeServerFailure
+	result.Answer = nil
+	return result
+}
+
+// decide returns the policy of the first rule matching domain or, when it resolved, its address
+func decide(rules ruleset.Matcher, domain, ip string) ruleset.Policy {
+	// 使用原始域名进行匹配，首个命中的规则生效；GEOIP 与 IP-CIDR 规则按应答地址匹配
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		return ruleset.DecideAnswer(rules, domain, addr)
+	}
+	return ruleset.Decide(rules, domain)
+}
+
+func negativeKind(rcode int) string {
+	if rcode == dns.RcodeNameError {
+		return "NXDOMAIN"
+	}
+	return "NODATA"
+}
+
+// followCNAMEs walks the CNAME records in answer starting at name and returns the last target
+func followCNAMEs(name string, answer []dns.RR) string {
+	for hops := 0; hops < len(answer); hops++ {
+		next := ""
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name
+}
+
+// addressOf returns the address carried by an A or AAAA record
+func addressOf(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	}
+	return ""
+}
+
+// firstAddress returns the first address of the queried type in an answer
+func firstAddress(answer []dns.RR, qtype uint16) string {
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype {
+			return addressOf(rr)
+		}
+	}
+	return ""
+}
+
+// LocalRulesPath holds hand-written rules, such as DIRECT exclusions, that are evaluated
+// before the subscription rules and survive subscription updates
+const LocalRulesPath = "assets/rule.list"
+
+// LoadRules loads the local rules, when the file exists, then the blocklists, then the
+// rules at path. Blocklists come before the subscription rules so ads under a VPN domain
+// are still rejected.
+func LoadRules(path string, blocklists ...string) ([]Rule, error) {
+	rules, err := LoadDomainRules(LocalRulesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, list := range blocklists {
+		blocked, err := LoadBlocklist(list)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, blocked...)
+	}
+	subscribed, err := LoadDomainRules(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, subscribed...), nil
+}
+
+// LoadBlocklist reads an adblock, hosts-file or rule-list blocklist into REJECT rules
+func LoadBlocklist(path string) ([]Rule, error) {
+	rules, unsupported, err := ruleset.ParseBlocklistFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(unsupported) > 0 {
+		log.Printf("⚠️ %d of %d lines in blocklist %s are not supported, e.g. %v", len(unsupported), len(rules)+len(unsupported), path, unsupported[0])
+	}
+	log.Printf("Loaded %d block rules from %s", len(rules), path)
+	return rules, nil
+}
+
+// LoadDomainRules reads a Clash/Surge rule list. Lines that are not understood are
+// logged with their line number and skipped.
+func LoadDomainRules(path string) ([]Rule, error) {
+	rules, unsupported, err := ruleset.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, perr := range unsupported {
+		log.Printf("⚠️ Skipping rule in %s %v", path, perr)
+	}
+	if len(unsupported) > 0 {
+		log.Printf("⚠️ %d of %d rules in %s are not supported", len(unsupported), len(rules)+len(unsupported), path)
+	}
+	return rules, nil
 }
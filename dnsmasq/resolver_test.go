@@ -0,0 +1,117 @@
+package dnsmasq_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/ruleset"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeUpstream answers every A query with one address after a delay and counts the queries it sees
+type fakeUpstream struct {
+	delay   time.Duration
+	queries atomic.Int32
+}
+
+func (u *fakeUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u.queries.Add(1)
+	time.Sleep(u.delay)
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	return reply, nil
+}
+
+func (u *fakeUpstream) String() string { return "fake" }
+
+var _ = Describe("Resolve", func() {
+	var (
+		upstream *fakeUpstream
+		client   *doh.Client
+		cache    *dnsmasq.Cache
+	)
+
+	BeforeEach(func() {
+		upstream = &fakeUpstream{delay: 100 * time.Millisecond}
+		client = &doh.Client{Upstreams: []doh.Upstream{upstream}, Timeout: time.Second}
+		cache = dnsmasq.NewCache()
+	})
+
+	It("shares one upstream lookup between concurrent identical queries", func() {
+		var wg sync.WaitGroup
+		results := make([]dnsmasq.ResolvedResult, 30)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = dnsmasq.Resolve(client, "cdn.example.com", dns.TypeA, dnsmasq.NewMatcher(nil, nil, ""), cache)
+			}(i)
+		}
+		wg.Wait()
+
+		Expect(upstream.queries.Load()).To(BeEquivalentTo(1))
+		for _, result := range results {
+			Expect(result.IP).To(Equal("192.0.2.1"))
+			Expect(result.Answer).To(HaveLen(1))
+		}
+	})
+
+	It("keeps lookups for different types apart", func() {
+		var wg sync.WaitGroup
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			wg.Add(1)
+			go func(qtype uint16) {
+				defer wg.Done()
+				dnsmasq.Resolve(client, "cdn.example.com", qtype, dnsmasq.NewMatcher(nil, nil, ""), cache)
+			}(qtype)
+		}
+		wg.Wait()
+
+		Expect(upstream.queries.Load()).To(BeEquivalentTo(2))
+	})
+})
+
+var _ = Describe("MatchesRules", func() {
+	It("decides through the compiled rules", func() {
+		rules, _, err := ruleset.Parse(strings.NewReader("DOMAIN,www.x.com,DIRECT\nDOMAIN-SUFFIX,x.com\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dnsmasq.MatchesRules("cdn.x.com", rules)).To(BeTrue())
+		Expect(dnsmasq.MatchesRules("www.x.com", rules)).To(BeFalse())
+	})
+})
+
+// countryDB places every address in one country
+type countryDB string
+
+func (c countryDB) Contains(code string, addr netip.Addr) bool {
+	return strings.EqualFold(code, string(c))
+}
+
+var _ = Describe("NewMatcher", func() {
+	rules, _, _ := ruleset.Parse(strings.NewReader("GEOIP,JP,VPN\n"))
+	addr := netip.MustParseAddr("203.0.113.1")
+
+	It("matches GEOIP rules through the database it is given", func() {
+		Expect(dnsmasq.NewMatcher(rules, countryDB("JP"), "").DecideAnswer("a.example", addr)).To(Equal(ruleset.PolicyVPN))
+		Expect(dnsmasq.NewMatcher(rules, nil, "").DecideAnswer("a.example", addr)).To(Equal(ruleset.PolicyDirect))
+	})
+
+	It("routes answers outside the given country via VPN", func() {
+		Expect(dnsmasq.NewMatcher(nil, countryDB("US"), "CN").DecideAnswer("a.example", addr)).To(Equal(ruleset.PolicyVPN))
+		Expect(dnsmasq.NewMatcher(nil, countryDB("CN"), "CN").DecideAnswer("a.example", addr)).To(Equal(ruleset.PolicyDirect))
+	})
+})
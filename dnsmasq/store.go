@@ -2,64 +2,261 @@ package dnsmasq
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"openvpnadvanced/internal/atomicfile"
+
+	"github.com/miekg/dns"
 )
 
-const cacheFilePath = "assets/cache.json"
+// DefaultCachePath is where the cache is persisted when no path is configured
+const DefaultCachePath = "assets/cache.json"
+
+// cacheSchemaVersion is written to cache.json; files without a version use the old per-domain layout
+const cacheSchemaVersion = 2
+
+// legacyCacheTTL is the lifetime entries had under the version 1 cache
+const legacyCacheTTL = 10 * time.Minute
 
 var storeLock sync.RWMutex
 
-func LoadCacheFromFile() (map[string]DNSRecord, error) {
+// ErrUnsupportedCacheVersion is returned for a cache file written by a newer version
+var ErrUnsupportedCacheVersion = errors.New("unsupported cache file version")
+
+type cacheFile struct {
+	Version int               `json:"version"`
+	Entries []cacheFileRecord `json:"entries"`
+}
+
+type cacheFileRecord struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     int       `json:"rcode,omitempty"`
+	Stored    time.Time `json:"stored"`
+	Records   []string  `json:"records,omitempty"` // zone file presentation format
+	Authority []string  `json:"authority,omitempty"`
+}
+
+// LoadCacheFromFile reads the entries persisted at path (DefaultCachePath if empty).
+// A file that cannot be decoded is moved aside to a quarantine name and yields no entries.
+// A file from a newer version is left alone and reported as ErrUnsupportedCacheVersion.
+func LoadCacheFromFile(path string) ([]CacheEntry, error) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if path == "" {
+		path = DefaultCachePath
+	}
+	bytes, err := readCacheBytes(path)
+	if err != nil || len(bytes) == 0 {
+		return nil, err
+	}
+
+	entries, err := decodeCache(bytes)
+	if errors.Is(err, ErrUnsupportedCacheVersion) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err != nil {
+		// 缓存文件损坏（例如写入时崩溃）：移走保留现场，以空缓存启动
+		quarantined := fmt.Sprintf("%s.corrupt-%s", path, time.Now().Format("20060102-150405"))
+		if renameErr := os.Rename(path, quarantined); renameErr != nil {
+			return nil, fmt.Errorf("cache file %s is unreadable (%v) and could not be moved aside: %v", path, err, renameErr)
+		}
+		log.Printf("⚠️ Cache file %s is unreadable, moved to %s: %v", path, quarantined, err)
+		return nil, nil
+	}
+	return entries, nil
+}
+
+// ReadCacheFile reads the entries persisted at path (DefaultCachePath if empty) without
+// ever changing the file, for tools that inspect the cache of a running proxy. Files that
+// cannot be decoded are reported as errors.
+func ReadCacheFile(path string) ([]CacheEntry, error) {
 	storeLock.RLock()
 	defer storeLock.RUnlock()
 
-	data := make(map[string]DNSRecord)
+	if path == "" {
+		path = DefaultCachePath
+	}
+	bytes, err := readCacheBytes(path)
+	if err != nil || len(bytes) == 0 {
+		return nil, err
+	}
+	entries, err := decodeCache(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
 
-	file, err := os.Open(cacheFilePath)
+// readCacheBytes returns the contents of the cache file, or nothing when it doesn't exist yet
+func readCacheBytes(path string) ([]byte, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return data, nil
+			return nil, nil
 		}
 		return nil, err
 	}
 	defer file.Close()
+	return io.ReadAll(file)
+}
 
-	bytes, err := io.ReadAll(file)
-	if err != nil {
+// decodeCache parses the contents of a cache file in either the current or the version 1 layout
+func decodeCache(bytes []byte) ([]CacheEntry, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &probe); err != nil {
 		return nil, err
 	}
+	if _, ok := probe["version"]; !ok {
+		return decodeLegacyCache(bytes)
+	}
 
-	if len(bytes) == 0 {
-		return data, nil
+	var data cacheFile
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return nil, err
+	}
+	if data.Version > cacheSchemaVersion {
+		return nil, fmt.Errorf("%w %d, this build reads up to version %d", ErrUnsupportedCacheVersion, data.Version, cacheSchemaVersion)
 	}
 
-	err = json.Unmarshal(bytes, &data)
-	if err != nil {
+	entries := make([]CacheEntry, 0, len(data.Entries))
+	for _, rec := range data.Entries {
+		qtype, ok := parseType(rec.Type)
+		if !ok {
+			continue
+		}
+		entry := CacheEntry{
+			Name:   rec.Name,
+			Qtype:  qtype,
+			Rcode:  rec.Rcode,
+			Answer: parseRecords(rec.Records),
+			Ns:     parseRecords(rec.Authority),
+			Stored: rec.Stored,
+		}
+		if len(entry.Answer) > 0 || len(entry.Ns) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// decodeLegacyCache converts a version 1 file, where each domain maps to one IP or CNAME target
+func decodeLegacyCache(bytes []byte) ([]CacheEntry, error) {
+	var legacy map[string]DNSRecord
+	if err := json.Unmarshal(bytes, &legacy); err != nil {
 		return nil, err
 	}
 
-	return data, nil
+	ttl := uint32(legacyCacheTTL / time.Second)
+	entries := make([]CacheEntry, 0, len(legacy))
+	for domain, record := range legacy {
+		hdr := dns.RR_Header{Name: dns.Fqdn(domain), Class: dns.ClassINET, Ttl: ttl}
+
+		var rr dns.RR
+		if ip := net.ParseIP(record.IP); ip == nil {
+			hdr.Rrtype = dns.TypeCNAME
+			rr = &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(record.IP)}
+		} else if ip.To4() != nil {
+			hdr.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: hdr, A: ip.To4()}
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+		}
+
+		entries = append(entries, CacheEntry{
+			Name:   hdr.Name,
+			Qtype:  hdr.Rrtype,
+			Answer: []dns.RR{rr},
+			Stored: record.Timestamp,
+		})
+	}
+	return entries, nil
 }
 
-func SaveCacheToFile(cache *Cache) error {
+// SaveCacheToFile writes the cache to path (DefaultCachePath if empty). The data goes to a
+// temporary file in the same directory that is renamed over path, so a crash never leaves
+// a partially written cache behind.
+func SaveCacheToFile(cache *Cache, path string) error {
 	storeLock.Lock()
 	defer storeLock.Unlock()
 
-	data := cache.Raw()
+	if path == "" {
+		path = DefaultCachePath
+	}
+
+	entries := cache.Entries()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Qtype < entries[j].Qtype
+	})
+
+	data := cacheFile{Version: cacheSchemaVersion, Entries: make([]cacheFileRecord, 0, len(entries))}
+	for _, e := range entries {
+		data.Entries = append(data.Entries, cacheFileRecord{
+			Name:      e.Name,
+			Type:      dns.Type(e.Qtype).String(),
+			Rcode:     e.Rcode,
+			Stored:    e.Stored,
+			Records:   formatRecords(e.Answer),
+			Authority: formatRecords(e.Ns),
+		})
+	}
 
 	bytes, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(cacheFilePath, bytes, 0644)
-	if err != nil {
+	if err := atomicfile.WriteFile(path, bytes, 0644); err != nil {
 		return err
 	}
 
-	fmt.Println("✅ Cache saved to cache.json")
+	fmt.Printf("✅ Cache saved to %s\n", path)
 	return nil
 }
+
+func formatRecords(rrs []dns.RR) []string {
+	lines := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		lines = append(lines, rr.String())
+	}
+	return lines
+}
+
+// parseRecords reads records in presentation format, skipping lines that fail to parse
+func parseRecords(lines []string) []dns.RR {
+	var rrs []dns.RR
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil || rr == nil {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// parseType accepts a type mnemonic or the generic TYPEnnn form written for unknown types
+func parseType(name string) (uint16, bool) {
+	if qtype, ok := dns.StringToType[name]; ok {
+		return qtype, true
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16); err == nil && strings.HasPrefix(name, "TYPE") {
+		return uint16(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,137 @@
+package dnsmasq_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache persistence", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		path = filepath.Join(dir, "cache.json")
+	})
+
+	It("round-trips entries through the file", func() {
+		cache := dnsmasq.NewCache()
+		cache.Set("example.com", dns.TypeA, []dns.RR{mustRR("example.com. 300 IN A 192.0.2.1")})
+		Expect(dnsmasq.SaveCacheToFile(cache, path)).To(Succeed())
+
+		entries, err := dnsmasq.LoadCacheFromFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Name).To(Equal("example.com."))
+		Expect(entries[0].Answer).To(HaveLen(1))
+	})
+
+	It("replaces the file without leaving temporary files behind", func() {
+		Expect(os.WriteFile(path, []byte("previous"), 0644)).To(Succeed())
+		Expect(dnsmasq.SaveCacheToFile(dnsmasq.NewCache(), path)).To(Succeed())
+
+		files, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+		Expect(files[0].Name()).To(Equal("cache.json"))
+	})
+
+	It("moves a corrupt file aside instead of failing", func() {
+		Expect(os.WriteFile(path, []byte(`{"version": 2, "entries": [`), 0644)).To(Succeed())
+
+		entries, err := dnsmasq.LoadCacheFromFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+
+		Expect(path).NotTo(BeAnExistingFile())
+		quarantined, err := filepath.Glob(path + ".corrupt-*")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(quarantined).To(HaveLen(1))
+	})
+
+	It("leaves a file from a newer version alone and reports it as unsupported", func() {
+		newer := []byte(`{"version": 99, "entries": []}`)
+		Expect(os.WriteFile(path, newer, 0644)).To(Succeed())
+
+		_, err := dnsmasq.LoadCacheFromFile(path)
+		Expect(err).To(MatchError(dnsmasq.ErrUnsupportedCacheVersion))
+		Expect(os.ReadFile(path)).To(Equal(newer))
+	})
+
+	It("reads without ever moving the file", func() {
+		Expect(os.WriteFile(path, []byte(`{"version": 2, "entries": [`), 0644)).To(Succeed())
+
+		_, err := dnsmasq.ReadCacheFile(path)
+		Expect(err).To(HaveOccurred())
+		Expect(path).To(BeAnExistingFile())
+
+		Expect(os.WriteFile(path, []byte(`{"version": 99, "entries": []}`), 0644)).To(Succeed())
+		_, err = dnsmasq.ReadCacheFile(path)
+		Expect(err).To(MatchError(dnsmasq.ErrUnsupportedCacheVersion))
+
+		cache := dnsmasq.NewCache()
+		cache.Set("example.com", dns.TypeA, []dns.RR{mustRR("example.com. 300 IN A 192.0.2.1")})
+		Expect(dnsmasq.SaveCacheToFile(cache, path)).To(Succeed())
+		entries, err := dnsmasq.ReadCacheFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("loads a version 1 file", func() {
+		// 与随附的 assets/cache.json 同样的格式：每个域名一条 IP 或 CNAME 目标
+		stored := time.Now().Add(-4 * time.Minute).Format(time.RFC3339Nano)
+		expired := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+		legacy := `{
+  "1-courier.push.apple.com": {"ip": "17.57.146.138", "timestamp": "` + stored + `"},
+  "10-courier.push.apple.com": {"ip": "eu-north-courier-4.push-apple.com.akadns.net.", "timestamp": "` + stored + `"},
+  "ipv6.example.com": {"ip": "2001:db8::1", "timestamp": "` + stored + `"},
+  "old.example.com": {"ip": "192.0.2.9", "timestamp": "` + expired + `"}
+}`
+		Expect(os.WriteFile(path, []byte(legacy), 0644)).To(Succeed())
+
+		entries, err := dnsmasq.LoadCacheFromFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(4))
+
+		cache := dnsmasq.NewCache()
+		Expect(cache.Restore(entries)).To(Equal(3))
+
+		entry, ok := cache.Get("1-courier.push.apple.com", dns.TypeA)
+		Expect(ok).To(BeTrue())
+		Expect(entry.Answer).To(HaveLen(1))
+		a, ok := entry.Answer[0].(*dns.A)
+		Expect(ok).To(BeTrue())
+		Expect(a.A.String()).To(Equal("17.57.146.138"))
+		Expect(a.Hdr.Ttl).To(BeNumerically("~", 360, 2))
+
+		entry, ok = cache.Get("10-courier.push.apple.com", dns.TypeCNAME)
+		Expect(ok).To(BeTrue())
+		Expect(entry.Answer).To(HaveLen(1))
+		cname, ok := entry.Answer[0].(*dns.CNAME)
+		Expect(ok).To(BeTrue())
+		Expect(cname.Target).To(Equal("eu-north-courier-4.push-apple.com.akadns.net."))
+		Expect(cname.Hdr.Ttl).To(BeNumerically("~", 360, 2))
+
+		entry, ok = cache.Get("ipv6.example.com", dns.TypeAAAA)
+		Expect(ok).To(BeTrue())
+		Expect(entry.Answer[0]).To(BeAssignableToTypeOf(&dns.AAAA{}))
+
+		_, ok = cache.Get("old.example.com", dns.TypeA)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("starts empty when there is no file yet", func() {
+		entries, err := dnsmasq.LoadCacheFromFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+})
@@ -0,0 +1,13 @@
+package dnsproxy_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDnsproxy(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dnsproxy Suite")
+}
@@ -0,0 +1,27 @@
+package dnsproxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ServeDNS runs a single query through the proxy's request handler
+func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.handleDNSRequest(w, r)
+}
+
+// AddRoute exposes addRoute to tests
+func (s *DNSServer) AddRoute(ip net.IP) {
+	s.addRoute(ip)
+}
+
+// IsSelf exposes isSelf to tests
+var IsSelf = isSelf
+
+// SetInstallRoute replaces the route installer and returns a function restoring it
+func SetInstallRoute(fn func(ip net.IP, iface string) error) func() {
+	old := installRoute
+	installRoute = fn
+	return func() { installRoute = old }
+}
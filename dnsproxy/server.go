@@ -1,30 +1,95 @@
 package dnsproxy
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/internal/singleflight"
+	"openvpnadvanced/ruleset"
 	"openvpnadvanced/utils"
 	"openvpnadvanced/vpn"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+// listenAddr is where the proxy accepts queries on both UDP and TCP
+const listenAddr = ":53"
+
+// blockTTL is the TTL of the 0.0.0.0 and :: answers given for blocked names
+const blockTTL = 60
+
+// BlockMode is how queries for domains with the REJECT policy are answered
+type BlockMode string
+
+const (
+	BlockNXDomain BlockMode = "nxdomain" // the name does not exist
+	BlockNull     BlockMode = "null"     // A 0.0.0.0 / AAAA ::, no data for other types
+	BlockRefused  BlockMode = "refused"  // the server refuses the query
+)
+
+// ParseBlockMode validates a block mode from config, defaulting to nxdomain
+func ParseBlockMode(name string) (BlockMode, error) {
+	switch mode := BlockMode(strings.ToLower(strings.TrimSpace(name))); mode {
+	case "":
+		return BlockNXDomain, nil
+	case BlockNXDomain, BlockNull, BlockRefused:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown block mode %q", name)
+	}
+}
+
 type DNSServer struct {
-	Rules    []dnsmasq.Rule
-	Cache    *dnsmasq.Cache
-	Fallback string
-	VPNIface string
+	Rules       []dnsmasq.Rule
+	Matcher     *ruleset.Set // Rules compiled for lookups
+	Cache       *dnsmasq.Cache
+	Upstream    *doh.Client // resolves direct domains
+	VPNUpstream *doh.Client // resolves VPN-bound domains through the tunnel; nil uses Upstream
+	Fallback    *doh.Client // classic resolvers retried when a direct lookup fails
+	VPNIface    string
+	BlockMode   BlockMode
+
+	routes singleflight.Group[struct{}] // coalesces concurrent installs of the same route
 }
 
-func NewServer(rules []dnsmasq.Rule, cache *dnsmasq.Cache, fallback string, vpnIface string) *DNSServer {
-	return &DNSServer{
-		Rules:    rules,
-		Cache:    cache,
-		Fallback: "127.0.0.1:53",
-		VPNIface: vpnIface,
+// installRoute adds a host route for ip through iface
+var installRoute = func(ip net.IP, iface string) error {
+	if ip.To4() == nil {
+		return vpn.AddIPv6Route(ip.String(), iface)
 	}
+	return vpn.AddRoute(ip.String(), iface)
+}
+
+// NewServer builds the proxy; fallback lists classic resolvers tried when the DoH path fails
+func NewServer(rules []dnsmasq.Rule, cache *dnsmasq.Cache, fallback []string, vpnIface string) (*DNSServer, error) {
+	chain := &doh.Client{Timeout: 3 * time.Second}
+	for _, spec := range fallback {
+		u, err := doh.ParseUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		if plain, ok := u.(*doh.PlainUpstream); ok && isSelf(plain.Addr) {
+			log.Printf("⚠️ Ignoring fallback %s: it points back at this DNS proxy", spec)
+			continue
+		}
+		chain.Upstreams = append(chain.Upstreams, u)
+	}
+
+	return &DNSServer{
+		Rules:     rules,
+		Matcher:   dnsmasq.NewMatcher(rules, nil, ""),
+		Cache:     cache,
+		Upstream:  doh.DefaultClient(),
+		Fallback:  chain,
+		VPNIface:  vpnIface,
+		BlockMode: BlockNXDomain,
+	}, nil
 }
 
 func (s *DNSServer) Start() {
@@ -32,16 +97,16 @@ func (s *DNSServer) Start() {
 	handler.HandleFunc(".", s.handleDNSRequest)
 
 	go func() {
-		server := &dns.Server{Addr: ":53", Net: "udp", Handler: handler}
-		log.Println("🌀 DNS server (UDP) listening on :53")
+		server := &dns.Server{Addr: listenAddr, Net: "udp", Handler: handler}
+		log.Printf("🌀 DNS server (UDP) listening on %s", listenAddr)
 		if err := server.ListenAndServe(); err != nil {
 			log.Fatalf("Failed to start UDP DNS server: %v", err)
 		}
 	}()
 
 	go func() {
-		server := &dns.Server{Addr: ":53", Net: "tcp", Handler: handler}
-		log.Println("🌀 DNS server (TCP) listening on :53")
+		server := &dns.Server{Addr: listenAddr, Net: "tcp", Handler: handler}
+		log.Printf("🌀 DNS server (TCP) listening on %s", listenAddr)
 		if err := server.ListenAndServe(); err != nil {
 			log.Fatalf("Failed to start TCP DNS server: %v", err)
 		}
@@ -60,75 +125,229 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	q := r.Question[0]
 	domain := strings.TrimSuffix(q.Name, ".")
 
-	switch q.Qtype {
-	case dns.TypeA:
-		// Handle A record normally
-	case dns.TypeAAAA, dns.TypeHTTPS, dns.TypeSVCB, dns.TypePTR, dns.TypeSOA:
-		msg.Answer = []dns.RR{}
-		_ = w.WriteMsg(msg)
+	// 按规则顺序取首个命中的策略：REJECT 直接拒绝，VPN 域名走隧道内 DNS，其余走本地/ISP 上游
+	policy := ruleset.Decide(s.Matcher, domain)
+	if policy == ruleset.PolicyReject {
+		s.reject(w, r, domain)
 		return
-	default:
-		log.Printf("⚠️ Unsupported query type: %d for %s", q.Qtype, domain)
-		msg.Answer = []dns.RR{}
-		_ = w.WriteMsg(msg)
+	}
+	viaVPN := policy == ruleset.PolicyVPN
+	upstream := s.upstreamFor(viaVPN)
+
+	// A/AAAA 走缓存与 CNAME 递归，其余类型原样转发给上游
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		s.forward(w, r, domain, viaVPN)
 		return
 	}
 
 	// 使用递归解析逻辑（带缓存）
-	shouldRoute, ip := dnsmasq.ResolveRecursive(domain, s.Rules, s.Cache)
+	result := dnsmasq.Resolve(upstream, domain, q.Qtype, s.Matcher, s.Cache)
+	if fallback := s.fallbackFor(viaVPN); result.Rcode == dns.RcodeServerFailure && fallback != nil {
+		resp, err := fallback.Exchange(context.Background(), r)
+		if err != nil {
+			log.Printf("⚠️ Fallback lookup failed for %s: %v", domain, err)
+		} else {
+			log.Printf("[FALLBACK] %s ➜ %d records", domain, len(resp.Answer))
+			result.Rcode, result.Answer, result.Ns = resp.Rcode, resp.Answer, resp.Ns
+		}
+	}
 
-	log.Printf("🔍 Domain: %s | IP: %s | VPN: %v", domain, ip, shouldRoute)
+	msg.Rcode = result.Rcode
+	msg.Answer = result.Answer
+	msg.Ns = result.Ns
+	msg.Compress = true
+	msg.Truncate(replySize(w, r))
+	_ = w.WriteMsg(msg)
 
-	if ip == "" {
+	if result.Rcode == dns.RcodeServerFailure {
 		utils.PrintError(domain, "failed to resolve")
+		return
+	}
+
+	ips := answerIPs(msg)
+	log.Printf("🔍 Domain: %s | IPs: %v | VPN: %v", domain, ips, viaVPN)
+	s.routeAnswers(domain, ips)
+}
+
+// forward relays a query of any type to the upstream and answers with its response unchanged
+func (s *DNSServer) forward(w dns.ResponseWriter, r *dns.Msg, domain string, viaVPN bool) {
+	qtype := dns.TypeToString[r.Question[0].Qtype]
+
+	resp, err := s.upstreamFor(viaVPN).Exchange(context.Background(), r)
+	if fallback := s.fallbackFor(viaVPN); err != nil && fallback != nil {
+		log.Printf("[FALLBACK] %s %s: %v", qtype, domain, err)
+		resp, err = fallback.Exchange(context.Background(), r)
+	}
+	if err != nil {
+		utils.PrintError(domain, fmt.Sprintf("%s lookup failed: %v", qtype, err))
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
 		_ = w.WriteMsg(msg)
 		return
 	}
 
-	msg.Answer = append(msg.Answer, makeARecord(domain, ip))
+	resp.Id = r.Id
+	resp.Compress = true
+	resp.Truncate(replySize(w, r))
+	_ = w.WriteMsg(resp)
+
+	log.Printf("🔍 Domain: %s | Type: %s | Answers: %d | VPN: %v", domain, qtype, len(resp.Answer), viaVPN)
+	// 应答中的 A/AAAA 地址同样按规则走 VPN
+	s.routeAnswers(domain, answerIPs(resp))
+}
+
+// reject answers a query for a domain whose first matching rule is REJECT, as set by BlockMode
+func (s *DNSServer) reject(w dns.ResponseWriter, r *dns.Msg, domain string) {
+	q := r.Question[0]
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+
+	switch s.BlockMode {
+	case BlockRefused:
+		msg.Rcode = dns.RcodeRefused
+	case BlockNull:
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockTTL}
+		switch q.Qtype {
+		case dns.TypeA:
+			msg.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			msg.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		}
+	default:
+		msg.Rcode = dns.RcodeNameError
+	}
 	_ = w.WriteMsg(msg)
 
-	printDNSLog(domain, ip, shouldRoute)
+	answer := dns.RcodeToString[msg.Rcode]
+	if ips := answerIPs(msg); len(ips) > 0 {
+		answer = ips[0].String()
+	}
+	log.Printf("[BLOCK] %s %s ➜ %s", dns.TypeToString[q.Qtype], domain, answer)
+	utils.PrintBlock(domain, answer)
+}
 
-	// 添加静态路由（确保 VPN 拦截）
-	if shouldRoute {
-		if err := vpn.AddRoute(ip, s.VPNIface); err != nil {
-			log.Printf("⚠️ Failed to add route for %s ➜ %s: %v", ip, s.VPNIface, err)
+// routeAnswers logs each answer address and routes it through the VPN when the first rule
+// matching the domain or the address, or the GeoIP outside mode, decides VPN
+func (s *DNSServer) routeAnswers(domain string, ips []net.IP) {
+	for _, ip := range ips {
+		addr, _ := netip.AddrFromSlice(ip)
+		route := s.Matcher.DecideAnswer(domain, addr) == ruleset.PolicyVPN
+		printDNSLog(domain, ip.String(), route)
+
+		// 为每个地址添加静态路由（确保 VPN 拦截）
+		if route {
+			s.addRoute(ip)
+		}
+	}
+}
+
+// addRoute sends traffic for ip through the VPN interface. Concurrent requests answered
+// with the same address share a single route install; later answers install it again, so
+// routes dropped with a reconnecting tunnel come back.
+func (s *DNSServer) addRoute(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	iface := s.VPNIface
+	s.routes.Do(iface+"|"+ip.String(), func() (struct{}, error) {
+		if err := installRoute(ip, iface); err != nil {
+			log.Printf("⚠️ Failed to add route for %s ➜ %s: %v", ip, iface, err)
 		} else {
-			log.Printf("✅ Route added: %s ➜ %s", ip, s.VPNIface)
+			log.Printf("✅ Route added: %s ➜ %s", ip, iface)
 		}
+		return struct{}{}, nil
+	})
+}
+
+// upstreamFor picks the resolver matching the rule verdict for a domain
+func (s *DNSServer) upstreamFor(viaVPN bool) *doh.Client {
+	if viaVPN && s.VPNUpstream != nil {
+		return s.VPNUpstream
 	}
+	return s.Upstream
 }
 
-// nolint: all
-func (s *DNSServer) forwardToFallback(domain string) (string, error) {
-	client := new(dns.Client)
-	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+// fallbackFor returns the classic resolvers to retry a failed lookup on, or nil when there
+// are none. VPN-bound names never fall back: asking the ISP resolvers would leak the name
+// and route the ISP's answer through the tunnel.
+func (s *DNSServer) fallbackFor(viaVPN bool) *doh.Client {
+	if viaVPN || s.Fallback == nil || len(s.Fallback.Upstreams) == 0 {
+		return nil
+	}
+	return s.Fallback
+}
+
+// isSelf reports whether addr resolves to this proxy's own listener
+func isSelf(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	_, listenPort, _ := net.SplitHostPort(listenAddr)
+	if port != listenPort {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return strings.EqualFold(host, "localhost")
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
 
-	resp, _, err := client.Exchange(msg, s.Fallback)
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		return "", err
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
 	}
+	return false
+}
 
-	for _, ans := range resp.Answer {
-		if a, ok := ans.(*dns.A); ok {
-			return a.A.String(), nil
+// answerIPs collects the addresses in A/AAAA records and SVCB/HTTPS hints of a response
+func answerIPs(resp *dns.Msg) []net.IP {
+	var ips []net.IP
+	for _, rr := range append(append([]dns.RR{}, resp.Answer...), resp.Extra...) {
+		switch v := rr.(type) {
+		case *dns.A:
+			ips = append(ips, v.A)
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA)
+		case *dns.SVCB:
+			ips = append(ips, svcbHints(v.Value)...)
+		case *dns.HTTPS:
+			ips = append(ips, svcbHints(v.Value)...)
 		}
 	}
-	return "", nil
+	return ips
 }
 
-func makeARecord(domain, ip string) dns.RR {
-	return &dns.A{
-		Hdr: dns.RR_Header{
-			Name:   dns.Fqdn(domain),
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET,
-			Ttl:    300,
-		},
-		A: net.ParseIP(ip),
+func svcbHints(values []dns.SVCBKeyValue) []net.IP {
+	var ips []net.IP
+	for _, kv := range values {
+		switch hint := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			ips = append(ips, hint.Hint...)
+		case *dns.SVCBIPv6Hint:
+			ips = append(ips, hint.Hint...)
+		}
+	}
+	return ips
+}
+
+// replySize is the largest response the client accepts over its transport
+func replySize(w dns.ResponseWriter, r *dns.Msg) int {
+	if w.LocalAddr().Network() == "tcp" {
+		return dns.MaxMsgSize
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
 	}
+	return dns.MinMsgSize
 }
 
 func printDNSLog(domain, ip string, vpn bool) {
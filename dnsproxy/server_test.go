@@ -0,0 +1,491 @@
+package dnsproxy_test
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/dnsproxy"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/ruleset"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// recorder is a dns.ResponseWriter that keeps the reply
+type recorder struct {
+	dns.ResponseWriter
+	reply *dns.Msg
+}
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	r.reply = m
+	return nil
+}
+
+func (r *recorder) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+// startUpstream runs a local DNS server with handler and returns its udp:// spec
+func startUpstream(handler dns.HandlerFunc) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() { _ = server.ActivateAndServe() }()
+	Eventually(started).Should(BeClosed())
+	DeferCleanup(server.Shutdown)
+	return "udp://" + conn.LocalAddr().String()
+}
+
+// answering replies to every query with addr, counting the queries in hits
+func answering(addr string, hits *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeA {
+			reply.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(addr),
+			}}
+		}
+		_ = w.WriteMsg(reply)
+	}
+}
+
+// zone answers queries from fixed records in presentation format, and NXDOMAIN for
+// names it has no records for
+func zone(records ...string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		q := r.Question[0]
+		known := false
+		for _, line := range records {
+			rr, err := dns.NewRR(line)
+			Expect(err).NotTo(HaveOccurred())
+			if strings.EqualFold(rr.Header().Name, q.Name) {
+				known = true
+				if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+					reply.Answer = append(reply.Answer, rr)
+				}
+			}
+		}
+		if !known {
+			reply.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(reply)
+	}
+}
+
+// failing answers every query with SERVFAIL
+func failing(w dns.ResponseWriter, r *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetRcode(r, dns.RcodeServerFailure)
+	_ = w.WriteMsg(reply)
+}
+
+// newClient returns a sequential client for the given upstream specs
+func newClient(specs ...string) *doh.Client {
+	client, err := doh.NewClient(specs)
+	Expect(err).NotTo(HaveOccurred())
+	return client
+}
+
+// serve runs one query through server and returns the reply
+func serve(server *dnsproxy.DNSServer, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	w := &recorder{}
+	server.ServeDNS(w, m)
+	Expect(w.reply).NotTo(BeNil())
+	return w.reply
+}
+
+var _ = Describe("Fallback", func() {
+	var (
+		server       *dnsproxy.DNSServer
+		fallbackHits atomic.Int32
+	)
+
+	BeforeEach(func() {
+		fallbackHits.Store(0)
+		rules, _, err := ruleset.Parse(strings.NewReader("DOMAIN-SUFFIX,corp.example,VPN\n"))
+		Expect(err).NotTo(HaveOccurred())
+		fallback := startUpstream(answering("192.0.2.53", &fallbackHits))
+		server, err = dnsproxy.NewServer(rules, dnsmasq.NewCache(), []string{fallback}, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+		server.Upstream = newClient(startUpstream(failing))
+		server.VPNUpstream = newClient(startUpstream(failing))
+	})
+
+	It("never asks the direct fallback for VPN-bound names", func() {
+		Expect(serve(server, "git.corp.example", dns.TypeA).Rcode).To(Equal(dns.RcodeServerFailure))
+		Expect(serve(server, "git.corp.example", dns.TypeTXT).Rcode).To(Equal(dns.RcodeServerFailure))
+		Expect(fallbackHits.Load()).To(BeZero())
+	})
+
+	It("asks the fallback for direct names", func() {
+		reply := serve(server, "example.org", dns.TypeA)
+		Expect(reply.Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(reply.Answer[0].(*dns.A).A.String()).To(Equal("192.0.2.53"))
+		Expect(fallbackHits.Load()).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Routes", func() {
+	var (
+		server  *dnsproxy.DNSServer
+		mu      sync.Mutex
+		routes  []string
+		failing bool
+	)
+
+	BeforeEach(func() {
+		routes, failing = nil, false
+		DeferCleanup(dnsproxy.SetInstallRoute(func(ip net.IP, iface string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if failing {
+				return errors.New("route: permission denied")
+			}
+			routes = append(routes, ip.String()+" "+iface)
+			return nil
+		}))
+
+		rules, _, err := ruleset.Parse(strings.NewReader("DOMAIN-SUFFIX,corp.example,VPN\n"))
+		Expect(err).NotTo(HaveOccurred())
+		server, err = dnsproxy.NewServer(rules, dnsmasq.NewCache(), nil, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+		server.VPNUpstream = newClient(startUpstream(zone(
+			"git.corp.example. 1 IN A 10.0.0.1",
+			"wiki.corp.example. 300 IN A 10.0.0.1",
+		)))
+	})
+
+	installed := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), routes...)
+	}
+
+	It("shares one install between concurrent answers", func() {
+		var calls atomic.Int32
+		release := make(chan struct{})
+		DeferCleanup(dnsproxy.SetInstallRoute(func(ip net.IP, iface string) error {
+			calls.Add(1)
+			<-release
+			return nil
+		}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				server.AddRoute(net.ParseIP("10.0.0.1"))
+			}()
+		}
+		Eventually(calls.Load).Should(BeEquivalentTo(1))
+		// 给其余请求时间加入进行中的安装
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		Expect(calls.Load()).To(BeEquivalentTo(1))
+	})
+
+	It("installs the route again when the answer is resolved anew", func() {
+		// 隧道重连后内核会丢弃路由，缓存过期后的新应答必须重新安装
+		serve(server, "git.corp.example", dns.TypeA)
+		time.Sleep(1100 * time.Millisecond)
+		serve(server, "git.corp.example", dns.TypeA)
+		Expect(installed()).To(Equal([]string{"10.0.0.1 utun0", "10.0.0.1 utun0"}))
+	})
+
+	It("installs the routes again when the VPN interface changes", func() {
+		serve(server, "wiki.corp.example", dns.TypeA)
+		server.VPNIface = "utun1"
+		serve(server, "wiki.corp.example", dns.TypeA)
+		Expect(installed()).To(Equal([]string{"10.0.0.1 utun0", "10.0.0.1 utun1"}))
+	})
+
+	It("retries an install that failed", func() {
+		failing = true
+		serve(server, "wiki.corp.example", dns.TypeA)
+		Expect(installed()).To(BeEmpty())
+
+		mu.Lock()
+		failing = false
+		mu.Unlock()
+		serve(server, "wiki.corp.example", dns.TypeA)
+		Expect(installed()).To(Equal([]string{"10.0.0.1 utun0"}))
+	})
+})
+
+var _ = Describe("Split upstreams", func() {
+	var (
+		server              *dnsproxy.DNSServer
+		directHits, vpnHits atomic.Int32
+	)
+
+	BeforeEach(func() {
+		directHits.Store(0)
+		vpnHits.Store(0)
+		rules, _, err := ruleset.Parse(strings.NewReader("DOMAIN-SUFFIX,corp.example,VPN\n"))
+		Expect(err).NotTo(HaveOccurred())
+		server, err = dnsproxy.NewServer(rules, dnsmasq.NewCache(), nil, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+		server.Upstream = newClient(startUpstream(answering("192.0.2.1", &directHits)))
+		server.VPNUpstream = newClient(startUpstream(answering("10.0.0.1", &vpnHits)))
+	})
+
+	It("resolves direct names through the direct upstream", func() {
+		reply := serve(server, "example.org", dns.TypeA)
+		Expect(reply.Answer[0].(*dns.A).A.String()).To(Equal("192.0.2.1"))
+		Expect(serve(server, "example.org", dns.TypeTXT).Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(directHits.Load()).To(BeEquivalentTo(2))
+		Expect(vpnHits.Load()).To(BeZero())
+	})
+
+	It("resolves VPN-bound names through the tunnel upstream", func() {
+		// TXT 应答不含地址，不会触发路由安装
+		Expect(serve(server, "git.corp.example", dns.TypeTXT).Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(vpnHits.Load()).To(BeEquivalentTo(1))
+		Expect(directHits.Load()).To(BeZero())
+	})
+
+	It("uses the direct upstream for VPN-bound names without a tunnel upstream", func() {
+		server.VPNUpstream = nil
+		Expect(serve(server, "git.corp.example", dns.TypeTXT).Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(directHits.Load()).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("Address answers", func() {
+	var (
+		server *dnsproxy.DNSServer
+		hits   atomic.Int32
+	)
+
+	BeforeEach(func() {
+		hits.Store(0)
+		var err error
+		server, err = dnsproxy.NewServer(nil, dnsmasq.NewCache(), nil, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+		records := zone(
+			"www.example.org. 300 IN CNAME cdn.example.net.",
+			"cdn.example.net. 120 IN CNAME edge.example.net.",
+			"edge.example.net. 60 IN A 192.0.2.1",
+			"edge.example.net. 60 IN A 192.0.2.2",
+			"edge.example.net. 30 IN AAAA 2001:db8::1",
+		)
+		server.Upstream = newClient(startUpstream(func(w dns.ResponseWriter, r *dns.Msg) {
+			hits.Add(1)
+			records(w, r)
+		}))
+	})
+
+	It("returns the whole CNAME chain and every address with the upstream TTLs", func() {
+		reply := serve(server, "www.example.org", dns.TypeA)
+		Expect(reply.Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(reply.Answer).To(HaveLen(4))
+
+		Expect(reply.Answer[0].(*dns.CNAME).Target).To(Equal("cdn.example.net."))
+		Expect(reply.Answer[0].Header().Ttl).To(BeEquivalentTo(300))
+		Expect(reply.Answer[1].(*dns.CNAME).Target).To(Equal("edge.example.net."))
+		Expect(reply.Answer[1].Header().Ttl).To(BeEquivalentTo(120))
+		Expect(reply.Answer[2].(*dns.A).A.String()).To(Equal("192.0.2.1"))
+		Expect(reply.Answer[3].(*dns.A).A.String()).To(Equal("192.0.2.2"))
+		Expect(reply.Answer[3].Header().Ttl).To(BeEquivalentTo(60))
+	})
+
+	It("answers AAAA queries with every IPv6 address", func() {
+		reply := serve(server, "www.example.org", dns.TypeAAAA)
+		Expect(reply.Answer).To(HaveLen(3))
+		Expect(reply.Answer[2].(*dns.AAAA).AAAA.String()).To(Equal("2001:db8::1"))
+	})
+
+	It("serves repeated queries from the cache with decremented TTLs", func() {
+		serve(server, "www.example.org", dns.TypeA)
+		upstream := hits.Load()
+
+		time.Sleep(1100 * time.Millisecond)
+		reply := serve(server, "www.example.org", dns.TypeA)
+		Expect(hits.Load()).To(Equal(upstream))
+		Expect(reply.Answer).To(HaveLen(4))
+		Expect(reply.Answer[0].Header().Ttl).To(BeNumerically("<", 300))
+		Expect(reply.Answer[3].Header().Ttl).To(BeNumerically("<", 60))
+	})
+})
+
+var _ = Describe("Other record types", func() {
+	var server *dnsproxy.DNSServer
+
+	BeforeEach(func() {
+		var err error
+		server, err = dnsproxy.NewServer(nil, dnsmasq.NewCache(), nil, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+		server.Upstream = newClient(startUpstream(zone(
+			"example.org. 3600 IN MX 10 mx1.example.org.",
+			"example.org. 3600 IN MX 20 mx2.example.org.",
+			"example.org. 300 IN TXT \"v=spf1 -all\"",
+			"_sip._tcp.example.org. 600 IN SRV 10 5 5060 sip.example.org.",
+			"1.2.0.192.in-addr.arpa. 86400 IN PTR host.example.org.",
+		)))
+	})
+
+	DescribeTable("forwards the upstream answer unchanged",
+		func(name string, qtype uint16, want int) {
+			m := new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(name), qtype)
+			w := &recorder{}
+			server.ServeDNS(w, m)
+
+			Expect(w.reply.Id).To(Equal(m.Id))
+			Expect(w.reply.Rcode).To(Equal(dns.RcodeSuccess))
+			Expect(w.reply.Answer).To(HaveLen(want))
+			for _, rr := range w.reply.Answer {
+				Expect(rr.Header().Rrtype).To(Equal(qtype))
+			}
+		},
+		Entry("MX", "example.org", dns.TypeMX, 2),
+		Entry("TXT", "example.org", dns.TypeTXT, 1),
+		Entry("SRV", "_sip._tcp.example.org", dns.TypeSRV, 1),
+		Entry("PTR", "1.2.0.192.in-addr.arpa", dns.TypePTR, 1),
+		Entry("no data", "example.org", dns.TypeCAA, 0),
+	)
+
+	It("keeps the record data and TTLs", func() {
+		reply := serve(server, "example.org", dns.TypeMX)
+		Expect(reply.Answer[0].(*dns.MX).Mx).To(Equal("mx1.example.org."))
+		Expect(reply.Answer[0].Header().Ttl).To(BeEquivalentTo(3600))
+	})
+
+	It("passes NXDOMAIN through", func() {
+		Expect(serve(server, "missing.example.org", dns.TypeMX).Rcode).To(Equal(dns.RcodeNameError))
+	})
+})
+
+var _ = Describe("Classic fallback", func() {
+	DescribeTable("isSelf",
+		func(addr string, want bool) {
+			Expect(dnsproxy.IsSelf(addr)).To(Equal(want))
+		},
+		Entry("loopback", "127.0.0.1:53", true),
+		Entry("IPv6 loopback", "[::1]:53", true),
+		Entry("localhost", "localhost:53", true),
+		Entry("unspecified", "0.0.0.0:53", true),
+		Entry("another port", "127.0.0.1:5353", false),
+		Entry("remote resolver", "192.0.2.1:53", false),
+		Entry("no port", "127.0.0.1", false),
+	)
+
+	It("recognises the addresses of local interfaces", func() {
+		addrs, err := net.InterfaceAddrs()
+		Expect(err).NotTo(HaveOccurred())
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				Expect(dnsproxy.IsSelf(net.JoinHostPort(ipNet.IP.String(), "53"))).To(BeTrue())
+			}
+		}
+	})
+
+	It("drops fallback entries that point back at the proxy", func() {
+		server, err := dnsproxy.NewServer(nil, dnsmasq.NewCache(), []string{"127.0.0.1", "udp://192.0.2.1:53", "tcp://localhost:53"}, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.Fallback.Upstreams).To(HaveLen(1))
+		Expect(server.Fallback.Upstreams[0].String()).To(Equal("udp://192.0.2.1:53"))
+	})
+
+	It("rejects an invalid fallback entry", func() {
+		_, err := dnsproxy.NewServer(nil, dnsmasq.NewCache(), []string{"ftp://192.0.2.1"}, "utun0")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("answers from the fallback when the upstream fails", func() {
+		var hits atomic.Int32
+		server, err := dnsproxy.NewServer(nil, dnsmasq.NewCache(), []string{startUpstream(answering("192.0.2.53", &hits))}, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+		server.Upstream = newClient(startUpstream(failing))
+
+		reply := serve(server, "example.org", dns.TypeA)
+		Expect(reply.Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(reply.Answer[0].(*dns.A).A.String()).To(Equal("192.0.2.53"))
+
+		// 非 A/AAAA 查询同样回退
+		Expect(serve(server, "example.org", dns.TypeTXT).Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(hits.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("answers SERVFAIL when the fallback fails too", func() {
+		server, err := dnsproxy.NewServer(nil, dnsmasq.NewCache(), []string{startUpstream(failing)}, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+		server.Upstream = newClient(startUpstream(failing))
+
+		Expect(serve(server, "example.org", dns.TypeA).Rcode).To(Equal(dns.RcodeServerFailure))
+		Expect(serve(server, "example.org", dns.TypeMX).Rcode).To(Equal(dns.RcodeServerFailure))
+	})
+})
+
+var _ = Describe("Blocking", func() {
+	var server *dnsproxy.DNSServer
+
+	BeforeEach(func() {
+		rules, _, err := ruleset.ParseBlocklist(strings.NewReader("||ads.example.com^\n"))
+		Expect(err).NotTo(HaveOccurred())
+		server, err = dnsproxy.NewServer(rules, dnsmasq.NewCache(), nil, "utun0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("answers NXDOMAIN by default", func() {
+		reply := serve(server, "banner.ads.example.com", dns.TypeA)
+		Expect(reply.Rcode).To(Equal(dns.RcodeNameError))
+		Expect(reply.Answer).To(BeEmpty())
+	})
+
+	It("answers REFUSED in refused mode", func() {
+		server.BlockMode = dnsproxy.BlockRefused
+		Expect(serve(server, "ads.example.com", dns.TypeA).Rcode).To(Equal(dns.RcodeRefused))
+	})
+
+	It("answers unspecified addresses in null mode", func() {
+		server.BlockMode = dnsproxy.BlockNull
+
+		reply := serve(server, "ads.example.com", dns.TypeA)
+		Expect(reply.Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(reply.Answer).To(HaveLen(1))
+		Expect(reply.Answer[0].(*dns.A).A.Equal(net.IPv4zero)).To(BeTrue())
+
+		reply = serve(server, "ads.example.com", dns.TypeAAAA)
+		Expect(reply.Answer[0].(*dns.AAAA).AAAA.Equal(net.IPv6zero)).To(BeTrue())
+
+		reply = serve(server, "ads.example.com", dns.TypeTXT)
+		Expect(reply.Rcode).To(Equal(dns.RcodeSuccess))
+		Expect(reply.Answer).To(BeEmpty())
+	})
+
+	DescribeTable("ParseBlockMode",
+		func(name string, want dnsproxy.BlockMode, ok bool) {
+			mode, err := dnsproxy.ParseBlockMode(name)
+			if !ok {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mode).To(Equal(want))
+		},
+		Entry("default", "", dnsproxy.BlockNXDomain, true),
+		Entry("null", "NULL", dnsproxy.BlockNull, true),
+		Entry("refused", "refused", dnsproxy.BlockRefused, true),
+		Entry("unknown", "drop", dnsproxy.BlockMode(""), false),
+	)
+})
@@ -0,0 +1,112 @@
+package doh_test
+
+import (
+	"net"
+	"time"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// startUDPServer runs a local DNS stand-in that answers every A query after delay
+func startUDPServer(ip string, delay time.Duration) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			time.Sleep(delay)
+			reply := new(dns.Msg)
+			reply.SetReply(r)
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+			_ = w.WriteMsg(reply)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	Eventually(started).Should(BeClosed())
+	DeferCleanup(server.Shutdown)
+	return conn.LocalAddr().String()
+}
+
+// deadUDPAddr returns a local address with nothing listening on it
+func deadUDPAddr() string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	addr := conn.LocalAddr().String()
+	Expect(conn.Close()).To(Succeed())
+	return addr
+}
+
+var _ = Describe("Client", func() {
+	lookup := func(c *doh.Client) string {
+		answers, err := c.QueryRR("example.com", dns.TypeA)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(answers).NotTo(BeEmpty())
+		return answers[0].(*dns.A).A.String()
+	}
+
+	It("takes the first answer when racing upstreams", func() {
+		slow := startUDPServer("192.0.2.1", 800*time.Millisecond)
+		fast := startUDPServer("192.0.2.2", 0)
+
+		client, err := doh.NewClient([]string{"udp://" + slow, "udp://" + fast})
+		Expect(err).NotTo(HaveOccurred())
+		client.Strategy = doh.StrategyRace
+
+		start := time.Now()
+		Expect(lookup(client)).To(Equal("192.0.2.2"))
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+
+		// The loser keeps running in the background and is scored once it answers
+		Eventually(func() string {
+			return client.Scores()[0].Upstream
+		}, 2*time.Second).Should(Equal("udp://" + fast))
+		Expect(client.Scores()[1].Queries).To(Equal(1))
+	})
+
+	It("demotes a failing upstream in sequential mode", func() {
+		dead := deadUDPAddr()
+		live := startUDPServer("192.0.2.3", 0)
+
+		client, err := doh.NewClient([]string{"tcp://" + dead, "udp://" + live})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(lookup(client)).To(Equal("192.0.2.3"))
+		Expect(lookup(client)).To(Equal("192.0.2.3"))
+
+		scores := client.Scores()
+		Expect(scores[0].Upstream).To(Equal("udp://" + live))
+		Expect(scores[1].Failures).To(Equal(1))
+	})
+
+	It("rejects unknown strategies", func() {
+		_, err := doh.ParseStrategy("roundrobin")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("ParseUpstream", func() {
+	DescribeTable("classic resolver shorthands",
+		func(spec, addr string) {
+			upstream, err := doh.ParseUpstream(spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upstream).To(BeAssignableToTypeOf(&doh.PlainUpstream{}))
+			Expect(upstream.(*doh.PlainUpstream).Addr).To(Equal(addr))
+			Expect(upstream.String()).To(Equal(spec))
+		},
+		Entry("IPv4", "192.168.1.1", "192.168.1.1:53"),
+		Entry("IPv6", "2001:4860:4860::8888", "[2001:4860:4860::8888]:53"),
+		Entry("IPv6 with zone", "fe80::1%en0", "[fe80::1%en0]:53"),
+		Entry("bracketed IPv6 with port", "[2001:db8::1]:5353", "[2001:db8::1]:5353"),
+		Entry("udp URL with IPv6", "udp://[::1]:5300", "[::1]:5300"),
+	)
+})
@@ -1,25 +1,16 @@
 package doh
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
-)
-
-// DoHAnswer represents a DNS answer
-type DoHAnswer struct {
-	Name string `json:"name"`
-	Type int    `json:"type"`
-	TTL  int    `json:"TTL"`
-	Data string `json:"data"`
-}
+	"sync"
+	"sync/atomic"
+	"time"
 
-// DoHResponse represents a DNS response
-type DoHResponse struct {
-	Answer []DoHAnswer `json:"Answer"`
-}
+	"github.com/miekg/dns"
+)
 
 // DNS record types (https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml)
 const (
@@ -34,52 +25,168 @@ const (
 	TypeSRV   = 33
 )
 
+// DefaultUpstream is used when no upstream endpoint is configured
+const DefaultUpstream = "https://cloudflare-dns.com/dns-query"
+
+// Strategy controls how a client spreads a query over its upstreams
+type Strategy string
+
+const (
+	// StrategySequential tries upstreams one at a time, fastest score first
+	StrategySequential Strategy = "sequential"
+	// StrategyRace queries every healthy upstream at once and keeps the first valid answer
+	StrategyRace Strategy = "race"
+)
+
+// ParseStrategy validates a strategy name from config, defaulting to sequential
+func ParseStrategy(name string) (Strategy, error) {
+	switch Strategy(strings.ToLower(strings.TrimSpace(name))) {
+	case "", StrategySequential:
+		return StrategySequential, nil
+	case StrategyRace:
+		return StrategyRace, nil
+	default:
+		return "", fmt.Errorf("unknown upstream strategy %q", name)
+	}
+}
+
+// Client sends queries to a list of upstreams and keeps a latency score for each
+type Client struct {
+	Upstreams []Upstream
+	Timeout   time.Duration
+	Strategy  Strategy
+
+	mu    sync.Mutex
+	stats map[Upstream]*upstreamStats
+}
+
+// NewClient parses the upstream specs, falling back to DefaultUpstream when none are given
+func NewClient(specs []string) (*Client, error) {
+	if len(specs) == 0 {
+		specs = []string{DefaultUpstream}
+	}
+	c := &Client{Timeout: 5 * time.Second, Strategy: StrategySequential}
+	for _, spec := range specs {
+		u, err := ParseUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		c.Upstreams = append(c.Upstreams, u)
+	}
+	return c, nil
+}
+
+var defaultClient atomic.Pointer[Client]
+
+func init() {
+	c, err := NewClient(nil)
+	if err != nil {
+		panic(err)
+	}
+	defaultClient.Store(c)
+}
+
+// DefaultClient returns the client used by the package-level Query functions
+func DefaultClient() *Client {
+	return defaultClient.Load()
+}
+
+// SetDefaultClient replaces the client used by the package-level Query functions
+func SetDefaultClient(c *Client) {
+	defaultClient.Store(c)
+}
+
 // Query returns the first A record (IPv4)
 func Query(domain string) (string, error) {
-	return querySingleType(domain, TypeA)
+	return DefaultClient().Query(domain)
 }
 
 // QueryA is an alias for Query (A record)
 func QueryA(domain string) (string, error) {
-	return querySingleType(domain, TypeA)
+	return DefaultClient().QueryA(domain)
 }
 
 // QueryAAAA returns the first AAAA record (IPv6)
 func QueryAAAA(domain string) (string, error) {
-	return querySingleType(domain, TypeAAAA)
+	return DefaultClient().QueryAAAA(domain)
 }
 
 // QueryTXT returns the first TXT record
 func QueryTXT(domain string) (string, error) {
-	return querySingleType(domain, TypeTXT)
+	return DefaultClient().QueryTXT(domain)
 }
 
 // QueryMX returns the first MX record
 func QueryMX(domain string) (string, error) {
-	return querySingleType(domain, TypeMX)
+	return DefaultClient().QueryMX(domain)
 }
 
 // QueryNS returns the first NS record
 func QueryNS(domain string) (string, error) {
-	return querySingleType(domain, TypeNS)
+	return DefaultClient().QueryNS(domain)
 }
 
 // QueryCNAME returns the first CNAME
 func QueryCNAME(domain string) (string, error) {
-	return querySingleType(domain, TypeCNAME)
+	return DefaultClient().QueryCNAME(domain)
 }
 
 // QueryAll returns all records of all known types for a domain
 func QueryAll(domain string) (map[string][]string, error) {
+	return DefaultClient().QueryAll(domain)
+}
+
+// QueryWithCNAME returns IP or next CNAME if found (for routing fallback)
+func QueryWithCNAME(domain string) (ip string, cname string, err error) {
+	return DefaultClient().QueryWithCNAME(domain)
+}
+
+// Query returns the first A record (IPv4)
+func (c *Client) Query(domain string) (string, error) {
+	return c.querySingleType(domain, TypeA)
+}
+
+// QueryA is an alias for Query (A record)
+func (c *Client) QueryA(domain string) (string, error) {
+	return c.querySingleType(domain, TypeA)
+}
+
+// QueryAAAA returns the first AAAA record (IPv6)
+func (c *Client) QueryAAAA(domain string) (string, error) {
+	return c.querySingleType(domain, TypeAAAA)
+}
+
+// QueryTXT returns the first TXT record
+func (c *Client) QueryTXT(domain string) (string, error) {
+	return c.querySingleType(domain, TypeTXT)
+}
+
+// QueryMX returns the first MX record
+func (c *Client) QueryMX(domain string) (string, error) {
+	return c.querySingleType(domain, TypeMX)
+}
+
+// QueryNS returns the first NS record
+func (c *Client) QueryNS(domain string) (string, error) {
+	return c.querySingleType(domain, TypeNS)
+}
+
+// QueryCNAME returns the first CNAME
+func (c *Client) QueryCNAME(domain string) (string, error) {
+	return c.querySingleType(domain, TypeCNAME)
+}
+
+// QueryAll returns all records of all known types for a domain
+func (c *Client) QueryAll(domain string) (map[string][]string, error) {
 	types := []int{TypeA, TypeAAAA, TypeCNAME, TypeMX, TypeTXT, TypeNS, TypeSOA, TypePTR, TypeSRV}
 	results := make(map[string][]string)
 
 	for _, t := range types {
-		records, err := queryRaw(domain, t)
+		records, err := c.queryRaw(domain, t)
 		if err == nil && len(records) > 0 {
 			typeStr := dnsTypeToString(t)
 			for _, rec := range records {
-				results[typeStr] = append(results[typeStr], rec.Data)
+				results[typeStr] = append(results[typeStr], rrData(rec))
 			}
 		}
 	}
@@ -88,77 +195,136 @@ func QueryAll(domain string) (map[string][]string, error) {
 }
 
 // QueryWithCNAME returns IP or next CNAME if found (for routing fallback)
-func QueryWithCNAME(domain string) (ip string, cname string, err error) {
-	url := fmt.Sprintf("https://cloudflare-dns.com/dns-query?name=%s&type=A", domain)
-
-	req, err := http.NewRequest("GET", url, nil)
+func (c *Client) QueryWithCNAME(domain string) (ip string, cname string, err error) {
+	answers, err := c.QueryRR(domain, dns.TypeA)
 	if err != nil {
 		return "", "", err
 	}
-	req.Header.Set("Accept", "application/dns-json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", "", err
+	for _, answer := range answers {
+		switch rr := answer.(type) {
+		case *dns.A:
+			return rr.A.String(), "", nil
+		case *dns.CNAME:
+			return "", strings.TrimSuffix(rr.Target, "."), nil
+		}
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
+	return "", "", fmt.Errorf("no A record or CNAME found")
+}
+
+// QueryRR returns the answer section for the given name and type
+func (c *Client) QueryRR(domain string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), qtype)
 
-	var dohRes DoHResponse
-	err = json.Unmarshal(body, &dohRes)
+	resp, err := c.Exchange(context.Background(), m)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
+	return resp.Answer, nil
+}
 
-	for _, answer := range dohRes.Answer {
-		switch answer.Type {
-		case TypeA:
-			return answer.Data, "", nil
-		case TypeCNAME:
-			return "", strings.TrimSuffix(answer.Data, "."), nil
-		}
+// Exchange sends the message according to the client strategy and returns the first valid response
+func (c *Client) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, errors.New("no upstream configured")
+	}
+	if c.Strategy == StrategyRace && len(c.Upstreams) > 1 {
+		return c.race(ctx, m)
 	}
 
-	return "", "", fmt.Errorf("no A record or CNAME found")
+	var lastErr error
+	for _, u := range c.ranked() {
+		resp, err := c.exchangeOne(ctx, u, m)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", u, err)
+	}
+	return nil, lastErr
 }
 
-// querySingleType fetches the first answer of a given DNS type
-func querySingleType(domain string, t int) (string, error) {
-	records, err := queryRaw(domain, t)
-	if err != nil || len(records) == 0 {
-		return "", fmt.Errorf("no %s record found", dnsTypeToString(t))
+// race queries every healthy upstream concurrently and returns the first valid answer
+func (c *Client) race(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// Losers keep running until their own timeout so their latency still feeds the score
+	ctx = context.WithoutCancel(ctx)
+
+	type result struct {
+		upstream Upstream
+		resp     *dns.Msg
+		err      error
 	}
-	return records[0].Data, nil
+
+	candidates := c.healthy()
+	results := make(chan result, len(candidates))
+	for _, u := range candidates {
+		go func(u Upstream) {
+			resp, err := c.exchangeOne(ctx, u, m.Copy())
+			results <- result{upstream: u, resp: resp, err: err}
+		}(u)
+	}
+
+	var lastErr error
+	for range candidates {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", r.upstream, r.err)
+	}
+	return nil, lastErr
 }
 
-// queryRaw returns all answers of the specified type
-func queryRaw(domain string, t int) ([]DoHAnswer, error) {
-	url := fmt.Sprintf("https://cloudflare-dns.com/dns-query?name=%s&type=%d", domain, t)
+// exchangeOne queries a single upstream, bounded by the client timeout, and records its latency
+func (c *Client) exchangeOne(ctx context.Context, u Upstream, m *dns.Msg) (*dns.Msg, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+	start := time.Now()
+	resp, err := u.Exchange(ctx, m)
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("upstream answered %s", dns.RcodeToString[resp.Rcode])
 	}
-	req.Header.Set("Accept", "application/dns-json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	c.record(u, time.Since(start), err)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return resp, nil
+}
 
-	body, _ := io.ReadAll(resp.Body)
+// querySingleType fetches the first answer of a given DNS type
+func (c *Client) querySingleType(domain string, t int) (string, error) {
+	records, err := c.queryRaw(domain, t)
+	if err != nil || len(records) == 0 {
+		return "", fmt.Errorf("no %s record found", dnsTypeToString(t))
+	}
+	return rrData(records[0]), nil
+}
 
-	var dohRes DoHResponse
-	err = json.Unmarshal(body, &dohRes)
+// queryRaw returns the answers that match the specified type
+func (c *Client) queryRaw(domain string, t int) ([]dns.RR, error) {
+	answers, err := c.QueryRR(domain, uint16(t))
 	if err != nil {
 		return nil, err
 	}
 
-	return dohRes.Answer, nil
+	var records []dns.RR
+	for _, rr := range answers {
+		if int(rr.Header().Rrtype) == t {
+			records = append(records, rr)
+		}
+	}
+	return records, nil
+}
+
+// rrData returns the presentation form of the record data without its header
+func rrData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
 }
 
 // dnsTypeToString maps DNS type code to human-readable name
@@ -1,7 +1,9 @@
 package doh_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -11,3 +13,10 @@ func TestDoh(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Doh Suite")
 }
+
+// ctx returns a context that bounds a single exchange in tests
+func ctx() context.Context {
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	DeferCleanup(cancel)
+	return c
+}
@@ -0,0 +1,16 @@
+package doh
+
+import (
+	"crypto/x509"
+	"net/http"
+)
+
+// SetHTTPClient swaps the HTTP client of a DoH upstream so tests can trust local servers
+func SetHTTPClient(u Upstream, c *http.Client) {
+	u.(*httpsUpstream).client = c
+}
+
+// SetRootCAs makes a DoT upstream trust the given roots instead of the system pool
+func SetRootCAs(u Upstream, pool *x509.CertPool) {
+	u.(*tlsUpstream).tlsConfig.RootCAs = pool
+}
@@ -0,0 +1,216 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Format selects the DoH dialect spoken by an upstream
+type Format string
+
+const (
+	FormatWire Format = "wire" // RFC 8484 application/dns-message
+	FormatJSON Format = "json" // application/dns-json
+)
+
+const (
+	mimeDNSMessage = "application/dns-message"
+	mimeDNSJSON    = "application/dns-json"
+)
+
+// DoHAnswer represents a DNS answer
+type DoHAnswer struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+	TTL  int    `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// DoHResponse represents a DNS response
+type DoHResponse struct {
+	Status    int         `json:"Status"`
+	TC        bool        `json:"TC"`
+	RD        bool        `json:"RD"`
+	RA        bool        `json:"RA"`
+	AD        bool        `json:"AD"`
+	CD        bool        `json:"CD"`
+	Answer    []DoHAnswer `json:"Answer"`
+	Authority []DoHAnswer `json:"Authority"`
+}
+
+type httpsUpstream struct {
+	spec     string
+	endpoint *url.URL
+	format   Format
+	method   string
+	client   *http.Client
+}
+
+func newHTTPSUpstream(spec string, u *url.URL) (*httpsUpstream, error) {
+	params := u.Query()
+	h := &httpsUpstream{
+		spec:   spec,
+		format: FormatWire,
+		method: http.MethodPost,
+		client: &http.Client{},
+	}
+
+	switch f := params.Get("format"); f {
+	case "", string(FormatWire):
+	case string(FormatJSON):
+		h.format = FormatJSON
+		h.method = http.MethodGet
+	default:
+		return nil, fmt.Errorf("unknown DoH format %q in %q", f, spec)
+	}
+
+	switch m := params.Get("method"); m {
+	case "":
+	case "get", "GET":
+		h.method = http.MethodGet
+	case "post", "POST":
+		if h.format == FormatJSON {
+			return nil, fmt.Errorf("JSON dialect only supports GET in %q", spec)
+		}
+		h.method = http.MethodPost
+	default:
+		return nil, fmt.Errorf("unknown DoH method %q in %q", m, spec)
+	}
+
+	params.Del("format")
+	params.Del("method")
+	endpoint := *u
+	endpoint.RawQuery = params.Encode()
+	h.endpoint = &endpoint
+	return h, nil
+}
+
+func (h *httpsUpstream) String() string {
+	return h.spec
+}
+
+func (h *httpsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if h.format == FormatJSON {
+		return h.exchangeJSON(ctx, m)
+	}
+	return h.exchangeWire(ctx, m)
+}
+
+// exchangeWire sends the packed message as RFC 8484 GET or POST
+func (h *httpsUpstream) exchangeWire(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 section 4.1 recommends ID 0 so responses stay cache friendly
+	query := m.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := *h.endpoint
+	var body io.Reader
+	if h.method == http.MethodGet {
+		params := endpoint.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+		endpoint.RawQuery = params.Encode()
+	} else {
+		body = bytes.NewReader(packed)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, h.method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mimeDNSMessage)
+	if body != nil {
+		req.Header.Set("Content-Type", mimeDNSMessage)
+	}
+
+	raw, err := h.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("invalid DNS message: %v", err)
+	}
+	resp.Id = m.Id
+	return resp, nil
+}
+
+// exchangeJSON queries the JSON dialect and converts the answer into a DNS message
+func (h *httpsUpstream) exchangeJSON(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) == 0 {
+		return nil, fmt.Errorf("query has no question")
+	}
+	q := m.Question[0]
+
+	endpoint := *h.endpoint
+	params := endpoint.Query()
+	params.Set("name", q.Name)
+	params.Set("type", strconv.Itoa(int(q.Qtype)))
+	endpoint.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mimeDNSJSON)
+
+	raw, err := h.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var dohRes DoHResponse
+	if err := json.Unmarshal(raw, &dohRes); err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.Rcode = dohRes.Status
+	resp.Truncated = dohRes.TC
+	resp.RecursionAvailable = dohRes.RA
+	resp.AuthenticatedData = dohRes.AD
+	resp.CheckingDisabled = dohRes.CD
+	resp.Answer = answersToRR(dohRes.Answer)
+	resp.Ns = answersToRR(dohRes.Authority)
+	return resp, nil
+}
+
+func (h *httpsUpstream) do(req *http.Request) ([]byte, error) {
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+}
+
+// answersToRR converts JSON answers into records, skipping any that fail to parse
+func answersToRR(answers []DoHAnswer) []dns.RR {
+	var rrs []dns.RR
+	for _, a := range answers {
+		line := fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(a.Name), a.TTL, dns.Type(a.Type).String(), a.Data)
+		rr, err := dns.NewRR(line)
+		if err != nil || rr == nil {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
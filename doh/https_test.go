@@ -0,0 +1,124 @@
+package doh_test
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTPS upstream", func() {
+	var (
+		server   *httptest.Server
+		lastReq  *http.Request
+		handler  http.HandlerFunc
+		upstream doh.Upstream
+	)
+
+	wireAnswer := func(w http.ResponseWriter, raw []byte) {
+		query := new(dns.Msg)
+		Expect(query.Unpack(raw)).To(Succeed())
+		Expect(query.Id).To(BeZero())
+
+		reply := new(dns.Msg)
+		reply.SetReply(query)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		packed, err := reply.Pack()
+		Expect(err).NotTo(HaveOccurred())
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}
+
+	BeforeEach(func() {
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lastReq = r
+			handler(w, r)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newUpstream := func(spec string) {
+		var err error
+		upstream, err = doh.ParseUpstream(spec)
+		Expect(err).NotTo(HaveOccurred())
+		doh.SetHTTPClient(upstream, server.Client())
+	}
+
+	query := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Id = 4242
+		resp, err := upstream.Exchange(ctx(), m)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Id).To(Equal(uint16(4242)))
+		return resp
+	}
+
+	It("posts RFC 8484 wireformat by default", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/dns-message"))
+			raw, err := io.ReadAll(r.Body)
+			Expect(err).NotTo(HaveOccurred())
+			wireAnswer(w, raw)
+		}
+		newUpstream(server.URL + "/dns-query")
+
+		resp := query()
+		Expect(resp.Answer).To(HaveLen(1))
+		a, ok := resp.Answer[0].(*dns.A)
+		Expect(ok).To(BeTrue())
+		Expect(a.A.String()).To(Equal("192.0.2.1"))
+		Expect(a.Hdr.Ttl).To(Equal(uint32(120)))
+	})
+
+	It("encodes the query in the dns parameter for GET", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Method).To(Equal(http.MethodGet))
+			Expect(r.URL.Query().Has("method")).To(BeFalse())
+			raw, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			Expect(err).NotTo(HaveOccurred())
+			wireAnswer(w, raw)
+		}
+		newUpstream(server.URL + "/dns-query?method=get")
+
+		Expect(query().Answer).To(HaveLen(1))
+	})
+
+	It("converts the JSON dialect into records", func() {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Header.Get("Accept")).To(Equal("application/dns-json"))
+			Expect(r.URL.Query().Get("name")).To(Equal("example.com."))
+			Expect(r.URL.Query().Get("type")).To(Equal("1"))
+			_, _ = io.WriteString(w, `{"Status":0,"Answer":[
+				{"name":"example.com","type":5,"TTL":60,"data":"edge.example.net."},
+				{"name":"edge.example.net","type":1,"TTL":30,"data":"192.0.2.7"}]}`)
+		}
+		newUpstream(server.URL + "/resolve?format=json")
+
+		resp := query()
+		Expect(lastReq.URL.Query().Has("format")).To(BeFalse())
+		Expect(resp.Answer).To(HaveLen(2))
+		Expect(resp.Answer[0]).To(BeAssignableToTypeOf(&dns.CNAME{}))
+		Expect(resp.Answer[1].(*dns.A).A.String()).To(Equal("192.0.2.7"))
+		Expect(resp.Answer[1].Header().Ttl).To(Equal(uint32(30)))
+	})
+
+	It("rejects unknown schemes", func() {
+		_, err := doh.ParseUpstream("gopher://example.com")
+		Expect(err).To(HaveOccurred())
+	})
+})
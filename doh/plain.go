@@ -0,0 +1,46 @@
+package doh
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const plainDefaultPort = "53"
+
+// PlainUpstream is a classic DNS server reached over UDP or TCP
+type PlainUpstream struct {
+	Spec string
+	Net  string // "udp" or "tcp"
+	Addr string // host:port
+}
+
+func newPlainUpstream(spec, network, host, port string) *PlainUpstream {
+	if port == "" {
+		port = plainDefaultPort
+	}
+	return &PlainUpstream{
+		Spec: spec,
+		Net:  network,
+		Addr: net.JoinHostPort(host, port),
+	}
+}
+
+func (p *PlainUpstream) String() string {
+	return p.Spec
+}
+
+// Exchange sends the query, retrying over TCP when a UDP answer comes back truncated
+func (p *PlainUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: p.Net}
+	resp, _, err := client.ExchangeContext(ctx, m, p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated && p.Net == "udp" {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, p.Addr)
+	}
+	return resp, err
+}
@@ -0,0 +1,132 @@
+package doh
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// scoreWeight is the share of a new sample in the moving latency average
+	scoreWeight = 0.3
+	// failurePenalty stands in for the latency of a failed query
+	failurePenalty = 5 * time.Second
+	// maxFailures consecutive errors bench an upstream for failureCooldown when racing
+	maxFailures     = 3
+	failureCooldown = 30 * time.Second
+)
+
+type upstreamStats struct {
+	latency  time.Duration // exponentially weighted moving average
+	queries  int
+	failures int // consecutive
+	lastFail time.Time
+}
+
+// UpstreamScore is a snapshot of one upstream's health for display
+type UpstreamScore struct {
+	Upstream string
+	Latency  time.Duration
+	Queries  int
+	Failures int
+}
+
+// record folds one query outcome into the upstream's score
+func (c *Client) record(u Upstream, rtt time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := c.statsLocked(u)
+	sample := rtt
+	if err != nil {
+		st.failures++
+		st.lastFail = time.Now()
+		if sample < failurePenalty {
+			sample = failurePenalty
+		}
+	} else {
+		st.failures = 0
+	}
+	st.observe(sample)
+}
+
+func (c *Client) statsLocked(u Upstream) *upstreamStats {
+	if c.stats == nil {
+		c.stats = make(map[Upstream]*upstreamStats)
+	}
+	st, ok := c.stats[u]
+	if !ok {
+		st = &upstreamStats{}
+		c.stats[u] = st
+	}
+	return st
+}
+
+func (st *upstreamStats) observe(sample time.Duration) {
+	if st.queries == 0 {
+		st.latency = sample
+	} else {
+		st.latency = time.Duration(scoreWeight*float64(sample) + (1-scoreWeight)*float64(st.latency))
+	}
+	st.queries++
+}
+
+// ranked returns the upstreams ordered by score; unmeasured ones keep their config order up front
+func (c *Client) ranked() []Upstream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ordered := append([]Upstream(nil), c.Upstreams...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return c.scoreLocked(ordered[i]) < c.scoreLocked(ordered[j])
+	})
+	return ordered
+}
+
+// healthy returns the upstreams not benched after repeated failures, or all of them if none qualify
+func (c *Client) healthy() []Upstream {
+	ranked := c.ranked()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var ok []Upstream
+	for _, u := range ranked {
+		st := c.stats[u]
+		if st != nil && st.failures >= maxFailures && time.Since(st.lastFail) < failureCooldown {
+			continue
+		}
+		ok = append(ok, u)
+	}
+	if len(ok) == 0 {
+		return ranked
+	}
+	return ok
+}
+
+func (c *Client) scoreLocked(u Upstream) time.Duration {
+	st := c.stats[u]
+	if st == nil {
+		return 0
+	}
+	return st.latency
+}
+
+// Scores returns the current latency score of every upstream in ranked order
+func (c *Client) Scores() []UpstreamScore {
+	ranked := c.ranked()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	scores := make([]UpstreamScore, 0, len(ranked))
+	for _, u := range ranked {
+		score := UpstreamScore{Upstream: u.String()}
+		if st := c.stats[u]; st != nil {
+			score.Latency = st.latency
+			score.Queries = st.queries
+			score.Failures = st.failures
+		}
+		scores = append(scores, score)
+	}
+	return scores
+}
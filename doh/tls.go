@@ -0,0 +1,229 @@
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dotDefaultPort = "853"
+	dotIdleTimeout = 30 * time.Second
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// tlsUpstream speaks DNS-over-TLS (RFC 7858) and pipelines queries over one persistent connection
+type tlsUpstream struct {
+	spec      string
+	addr      string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+func newTLSUpstream(spec string, u *url.URL) (*tlsUpstream, error) {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = dotDefaultPort
+	}
+
+	serverName := host
+	if sni := u.Query().Get("sni"); sni != "" {
+		serverName = sni
+	}
+
+	return &tlsUpstream{
+		spec: spec,
+		addr: net.JoinHostPort(host, port),
+		tlsConfig: &tls.Config{
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		},
+	}, nil
+}
+
+func (t *tlsUpstream) String() string {
+	return t.spec
+}
+
+func (t *tlsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// A pooled connection may have been closed by the server while idle, so retry once on a fresh one
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := t.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := conn.exchange(ctx, m)
+		if err == nil {
+			return resp, nil
+		}
+		// 单个查询超时或被取消不影响连接上的其他查询，只有读写或帧错误才丢弃连接
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		t.dropConn(conn)
+		if !reused || attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// getConn returns the live connection, dialing a new one if needed
+func (t *tlsUpstream) getConn(ctx context.Context) (*dotConn, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil && !t.conn.isClosed() {
+		return t.conn, true, nil
+	}
+
+	dialer := &tls.Dialer{Config: t.tlsConfig.Clone()}
+	raw, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.conn = newDotConn(raw)
+	return t.conn, false, nil
+}
+
+func (t *tlsUpstream) dropConn(conn *dotConn) {
+	conn.close(errConnClosed)
+
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.mu.Unlock()
+}
+
+// dotConn multiplexes in-flight queries on a single TLS stream by message ID
+type dotConn struct {
+	conn    *dns.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	err     error
+	done    chan struct{}
+}
+
+func newDotConn(raw net.Conn) *dotConn {
+	c := &dotConn{
+		conn:    &dns.Conn{Conn: raw},
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *dotConn) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+	id, err := c.register(ch)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	query := m.Copy()
+	query.Id = id
+
+	deadline, _ := ctx.Deadline()
+	c.writeMu.Lock()
+	_ = c.conn.SetWriteDeadline(deadline)
+	err = c.conn.WriteMsg(query)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		resp.Id = m.Id
+		return resp, nil
+	case <-c.done:
+		return nil, c.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// register reserves an unused message ID for a pending query
+func (c *dotConn) register(ch chan *dns.Msg) (uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	for {
+		id := uint16(rand.N(1 << 16))
+		if _, busy := c.pending[id]; !busy {
+			c.pending[id] = ch
+			return id, nil
+		}
+	}
+}
+
+func (c *dotConn) unregister(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// readLoop dispatches responses to their waiting queries until the connection fails or idles out
+func (c *dotConn) readLoop() {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+		resp, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(fmt.Errorf("read: %w", err))
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Id]
+		delete(c.pending, resp.Id)
+		c.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (c *dotConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	_ = c.conn.Close()
+}
+
+func (c *dotConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+func (c *dotConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
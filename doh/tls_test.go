@@ -0,0 +1,185 @@
+package doh_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openvpnadvanced/doh"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// countingListener counts accepted connections so tests can assert on reuse
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// selfSignedCert returns a certificate for dns.test and the pool that trusts it
+func selfSignedCert() (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	leaf, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+var _ = Describe("TLS upstream", func() {
+	var (
+		listener   *countingListener
+		server     *dns.Server
+		pool       *x509.CertPool
+		serverName atomic.Value
+	)
+
+	BeforeEach(func() {
+		cert, roots := selfSignedCert()
+		pool = roots
+
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		listener = &countingListener{Listener: tcp}
+
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				serverName.Store(hello.ServerName)
+				return nil, nil
+			},
+		}
+
+		mux := dns.NewServeMux()
+		mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name == "slow.example.com." {
+				time.Sleep(300 * time.Millisecond)
+			}
+			reply := new(dns.Msg)
+			reply.SetReply(r)
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.53"),
+			})
+			_ = w.WriteMsg(reply)
+		})
+
+		started := make(chan struct{})
+		server = &dns.Server{
+			Listener:          tls.NewListener(listener, tlsConfig),
+			Net:               "tcp-tls",
+			Handler:           mux,
+			NotifyStartedFunc: func() { close(started) },
+		}
+		go func() { _ = server.ActivateAndServe() }()
+		Eventually(started).Should(BeClosed())
+	})
+
+	AfterEach(func() {
+		_ = server.Shutdown()
+	})
+
+	newUpstream := func(query string) doh.Upstream {
+		u, err := doh.ParseUpstream("tls://" + listener.Addr().String() + query)
+		Expect(err).NotTo(HaveOccurred())
+		doh.SetRootCAs(u, pool)
+		return u
+	}
+
+	lookup := func(c context.Context, u doh.Upstream, name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		resp, err := u.Exchange(c, m)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Id).To(Equal(m.Id))
+		return resp
+	}
+
+	It("sends the pinned server name", func() {
+		u := newUpstream("?sni=dns.test")
+
+		resp := lookup(ctx(), u, "example.com")
+		Expect(resp.Answer).To(HaveLen(1))
+		Expect(serverName.Load()).To(Equal("dns.test"))
+	})
+
+	It("refuses a certificate that does not match the server name", func() {
+		u := newUpstream("?sni=other.test")
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		_, err := u.Exchange(ctx(), m)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("pipelines concurrent queries over one connection", func() {
+		u := newUpstream("?sni=dns.test")
+
+		c := ctx()
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				resp := lookup(c, u, "pipelined.example.com")
+				Expect(resp.Answer[0].Header().Name).To(Equal("pipelined.example.com."))
+			}()
+		}
+		wg.Wait()
+
+		lookup(c, u, "again.example.com")
+		Expect(listener.accepted.Load()).To(Equal(int32(1)))
+	})
+
+	It("keeps the connection when one query times out", func() {
+		u := newUpstream("?sni=dns.test")
+		lookup(ctx(), u, "first.example.com")
+
+		short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		m := new(dns.Msg)
+		m.SetQuestion("slow.example.com.", dns.TypeA)
+		_, err := u.Exchange(short, m)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		resp := lookup(ctx(), u, "after.example.com")
+		Expect(resp.Answer[0].Header().Name).To(Equal("after.example.com."))
+		Expect(listener.accepted.Load()).To(Equal(int32(1)))
+	})
+})
@@ -0,0 +1,62 @@
+package doh
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a single DNS server the client can send queries to
+type Upstream interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// ParseUpstream builds an upstream from its config spec.
+//
+// Supported forms:
+//
+//	https://host/dns-query              RFC 8484 wireformat over POST
+//	https://host/dns-query?method=get   RFC 8484 wireformat over GET
+//	https://host/resolve?format=json    JSON dialect (application/dns-json)
+//	tls://1.1.1.1:853?sni=name          DNS-over-TLS, port defaults to 853
+//	udp://192.168.1.1:53                classic DNS over UDP, port defaults to 53
+//	tcp://192.168.1.1:53                classic DNS over TCP
+//	192.168.1.1                         shorthand for udp://192.168.1.1
+//	2001:4860:4860::8888                shorthand for udp://[2001:4860:4860::8888]
+//
+// The format, method and sni parameters are client options and are not sent upstream.
+func ParseUpstream(spec string) (Upstream, error) {
+	spec = strings.TrimSpace(spec)
+	raw := spec
+	if !strings.Contains(raw, "://") {
+		// 裸 IPv6 地址需加方括号，否则冒号会被当作端口分隔符
+		if addr, err := netip.ParseAddr(raw); err == nil && addr.Is6() {
+			raw = "[" + strings.Replace(raw, "%", "%25", 1) + "]"
+		}
+		raw = "udp://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %v", spec, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q: missing host", spec)
+	}
+
+	switch u.Scheme {
+	case "https":
+		return newHTTPSUpstream(spec, u)
+	case "tls":
+		return newTLSUpstream(spec, u)
+	case "udp", "tcp":
+		return newPlainUpstream(spec, u.Scheme, u.Hostname(), u.Port()), nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q in %q", u.Scheme, spec)
+	}
+}
@@ -0,0 +1,75 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDecodedSize bounds a decompressed subscription body
+const maxDecodedSize = 64 << 20
+
+// Decode unwraps a subscription body that is gzip-compressed or base64-encoded, as many
+// lists such as gfwlist are, even when the server doesn't say so. It returns the body
+// and the encodings removed, outermost first.
+func Decode(body []byte) ([]byte, []string, error) {
+	var encodings []string
+	for len(encodings) < 4 {
+		switch {
+		case bytes.HasPrefix(body, []byte{0x1f, 0x8b}):
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, encodings, fmt.Errorf("invalid gzip body: %v", err)
+			}
+			decoded, err := io.ReadAll(io.LimitReader(zr, maxDecodedSize+1))
+			if err != nil {
+				return nil, encodings, fmt.Errorf("invalid gzip body: %v", err)
+			}
+			if len(decoded) > maxDecodedSize {
+				return nil, encodings, fmt.Errorf("gzip body larger than %d MB", maxDecodedSize>>20)
+			}
+			body = decoded
+			encodings = append(encodings, "gzip")
+		default:
+			decoded, ok := decodeBase64(body)
+			if !ok {
+				return body, encodings, nil
+			}
+			body = decoded
+			encodings = append(encodings, "base64")
+		}
+	}
+	return body, encodings, nil
+}
+
+// decodeBase64 decodes body when it consists only of base64 text, wrapped or not, that
+// decodes to text or gzip. Rule lists always contain a comma or dot, so they never qualify.
+func decodeBase64(body []byte) ([]byte, bool) {
+	compact := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, string(body))
+	if len(compact) < 8 {
+		return nil, false
+	}
+	for _, c := range compact {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("+/-_=", c)) {
+			return nil, false
+		}
+	}
+
+	trimmed := strings.TrimRight(compact, "=")
+	for _, enc := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		decoded, err := enc.DecodeString(trimmed)
+		if err == nil && (utf8.Valid(decoded) || bytes.HasPrefix(decoded, []byte{0x1f, 0x8b})) {
+			return decoded, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,104 @@
+package fetcher_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+
+	"openvpnadvanced/fetcher"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+	return buf.Bytes()
+}
+
+// wrapped base64-encodes data in 64-column lines, as gfwlist is published
+func wrapped(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var out []byte
+	for len(encoded) > 64 {
+		out = append(out, encoded[:64]+"\n"...)
+		encoded = encoded[64:]
+	}
+	return append(out, encoded+"\n"...)
+}
+
+const gfwlist = `[AutoProxy 0.2.9]
+! Checksum: abc
+! Expires: 6h
+||google.com
+|https://www.example.org/path
+.twitter.com
+youtube.com/watch
+|http://8.8.8.8
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+||google.*
+@@||cn.example.org
+!##############General List End#################
+`
+
+var _ = Describe("Decode", func() {
+	rules := []byte("DOMAIN-SUFFIX,x.com\nDOMAIN,y.com\n")
+
+	DescribeTable("unwraps",
+		func(body []byte, want []string) {
+			decoded, encodings, err := fetcher.Decode(body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded).To(Equal(rules))
+			Expect(encodings).To(Equal(want))
+		},
+		Entry("plain text", rules, nil),
+		Entry("gzip", gzipped(rules), []string{"gzip"}),
+		Entry("base64", []byte(base64.StdEncoding.EncodeToString(rules)), []string{"base64"}),
+		Entry("base64 without padding", []byte(base64.RawStdEncoding.EncodeToString(rules)), []string{"base64"}),
+		Entry("wrapped base64", wrapped(rules), []string{"base64"}),
+		Entry("base64 of gzip", wrapped(gzipped(rules)), []string{"base64", "gzip"}),
+	)
+
+	It("leaves text that only looks like base64 alone when it doesn't decode to text", func() {
+		body := []byte("////////////")
+		decoded, encodings, err := fetcher.Decode(body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(body))
+		Expect(encodings).To(BeEmpty())
+	})
+
+	It("reports a truncated gzip body", func() {
+		_, _, err := fetcher.Decode(gzipped(rules)[:12])
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("AutoProxy lists", func() {
+	It("decodes and converts gfwlist into suffix rules", func() {
+		body, _, err := fetcher.Decode(wrapped([]byte(gfwlist)))
+		Expect(err).NotTo(HaveOccurred())
+
+		rules, format, err := fetcher.Convert(body, fetcher.Subscription{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format).To(Equal(fetcher.FormatABP))
+		Expect(rules).To(Equal([]string{
+			"DOMAIN-SUFFIX,cn.example.org,DIRECT",
+			"DOMAIN-SUFFIX,google.com",
+			"DOMAIN-SUFFIX,www.example.org",
+			"DOMAIN-SUFFIX,twitter.com",
+			"DOMAIN-SUFFIX,youtube.com",
+			"IP-CIDR,8.8.8.8/32",
+		}))
+	})
+
+	It("converts Adblock Plus filters", func() {
+		rules, format, err := fetcher.Convert([]byte("! Title: ads\n||ads.example.com^\n||tracker.example.net^$third-party\nexample.com##.banner\n"), fetcher.Subscription{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format).To(Equal(fetcher.FormatABP))
+		// 带选项的过滤器只作用于部分请求，与屏蔽列表一样跳过
+		Expect(rules).To(Equal([]string{"DOMAIN-SUFFIX,ads.example.com"}))
+	})
+})
@@ -1,75 +1,276 @@
 package fetcher
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
+
+	"openvpnadvanced/internal/atomicfile"
+)
+
+// Defaults used by NewFetcher
+const (
+	DefaultConcurrency = 4
+	DefaultTimeout     = 30 * time.Second
+	DefaultRetries     = 3
+	DefaultBackoff     = time.Second
 )
 
+// Fetcher downloads subscriptions in parallel. Each attempt has its own timeout, and
+// failed attempts are retried with exponential backoff.
+type Fetcher struct {
+	Client      *http.Client
+	Concurrency int           // subscriptions fetched at once
+	Timeout     time.Duration // limit for one attempt, including reading the body
+	Retries     int           // attempts after the first
+	Backoff     time.Duration // wait before the first retry, doubled for each one after
+}
+
+// NewFetcher returns a Fetcher with the default limits
+func NewFetcher() *Fetcher {
+	return &Fetcher{
+		Client:      http.DefaultClient,
+		Concurrency: DefaultConcurrency,
+		Timeout:     DefaultTimeout,
+		Retries:     DefaultRetries,
+		Backoff:     DefaultBackoff,
+	}
+}
+
+// Result is the outcome of fetching one subscription
+type Result struct {
+	Subscription Subscription
+	Rules        []string
+	Format       Format
+	Encodings    []string
+	Attempts     int
+	Duration     time.Duration
+	Err          error
+	Kept         int // rules from the previous fetch kept by FetchAndMerge after a failure
+}
+
+// FetchAndMergeRules fetches the subscriptions listed in subscriptionFile, merges their
+// rules into outputFile and prints a line per subscription
 func FetchAndMergeRules(subscriptionFile, outputFile string) error {
-	urls, err := readSubscriptionURLs(subscriptionFile)
+	results, err := NewFetcher().FetchAndMerge(context.Background(), subscriptionFile, outputFile)
+	PrintSummary(results)
+	return err
+}
+
+// sectionPrefix marks the rules of one subscription in the merged file, so a subscription
+// that fails to download can keep the rules it had
+const sectionPrefix = "# subscription: "
+
+// FetchAndMerge fetches the subscriptions listed in subscriptionFile and writes their rules
+// to outputFile in subscription order. A subscription that fails keeps the rules it had in
+// outputFile. When those can't be told apart, because the file predates the per-subscription
+// sections, or when every subscription fails, outputFile is left as it was.
+func (f *Fetcher) FetchAndMerge(ctx context.Context, subscriptionFile, outputFile string) ([]Result, error) {
+	subs, err := readSubscriptions(subscriptionFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	results := f.FetchAll(ctx, subs)
 
-	ruleSet := make(map[string]struct{})
-
-	for _, url := range urls {
-		resp, err := http.Get(url)
-		if err != nil {
-			fmt.Printf("Failed to fetch %s: %v\n", url, err)
-			continue
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
 		}
-		defer resp.Body.Close()
+	}
+	if len(results) > 0 && failed == len(results) {
+		fmt.Printf("⚠️ No subscription could be fetched, keeping %s\n", outputFile)
+		return results, nil
+	}
+	previous, sectioned, err := readMerged(outputFile)
+	if err != nil {
+		return results, err
+	}
+	if failed > 0 && !sectioned && len(previous[""]) > 0 {
+		fmt.Printf("⚠️ %d subscriptions could not be fetched and %s has no per-subscription sections, keeping it\n", failed, outputFile)
+		return results, nil
+	}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("Failed to read from %s: %v\n", url, err)
-			continue
+	// 规则按首次出现的顺序保留：规则按顺序匹配，首个命中的生效
+	var out bytes.Buffer
+	seen := make(map[string]struct{})
+	total := 0
+	for i := range results {
+		result := &results[i]
+		rules := result.Rules
+		if result.Err != nil {
+			// 下载失败时沿用该订阅上次的规则
+			rules = previous[result.Subscription.String()]
+			result.Kept = len(rules)
 		}
-
-		lines := strings.Split(string(body), "\n")
-		for _, line := range lines {
-			rule := strings.TrimSpace(line)
-			if rule == "" || strings.HasPrefix(rule, "#") {
-				continue
+		fmt.Fprintf(&out, "%s%s\n", sectionPrefix, result.Subscription)
+		for _, rule := range rules {
+			if _, ok := seen[rule]; !ok {
+				seen[rule] = struct{}{}
+				out.WriteString(rule + "\n")
+				total++
 			}
-			ruleSet[rule] = struct{}{}
 		}
 	}
+	if err := atomicfile.WriteFile(outputFile, out.Bytes(), 0644); err != nil {
+		return results, err
+	}
+
+	fmt.Printf("✅ Merged %d unique rules into %s\n", total, outputFile)
+	return results, nil
+}
 
-	// Write merged rules to file
-	out, err := os.Create(outputFile)
+// readMerged reads the rules of a merged file by subscription. Rules before the first
+// section, as in files written before sections were added, are listed under "".
+func readMerged(path string) (map[string][]string, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+
+	sections := make(map[string][]string)
+	current, sectioned := "", false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, sectionPrefix); ok {
+			current, sectioned = name, true
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sections[current] = append(sections[current], line)
 	}
-	defer out.Close()
+	return sections, sectioned, nil
+}
 
-	for rule := range ruleSet {
-		_, _ = out.WriteString(rule + "\n")
+// FetchAll fetches and converts subscriptions, at most Concurrency at a time, and returns
+// their results in the same order
+func (f *Fetcher) FetchAll(ctx context.Context, subs []Subscription) []Result {
+	results := make([]Result, len(subs))
+	slots := make(chan struct{}, max(f.Concurrency, 1))
+	var wg sync.WaitGroup
+
+	for i, sub := range subs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i] = f.fetch(ctx, sub)
+		}()
 	}
+	wg.Wait()
+	return results
+}
+
+// fetch downloads and converts one subscription, retrying failed downloads
+func (f *Fetcher) fetch(ctx context.Context, sub Subscription) (result Result) {
+	result.Subscription = sub
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	var body []byte
+	delay := f.Backoff
+	for {
+		result.Attempts++
+		var retry bool
+		body, retry, result.Err = f.download(ctx, sub.URL)
+		if result.Err == nil || !retry || result.Attempts > f.Retries {
+			break
+		}
+		// 指数退避后重试，等待期间可被取消
+		select {
+		case <-ctx.Done():
+			result.Err = ctx.Err()
+			return result
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if result.Err != nil {
+		return result
+	}
+
+	if body, result.Encodings, result.Err = Decode(body); result.Err != nil {
+		return result
+	}
+	result.Rules, result.Format, result.Err = Convert(body, sub)
+	return result
+}
 
-	fmt.Printf("✅ Merged %d unique rules into %s\n", len(ruleSet), outputFile)
-	return nil
+// errStatus is a non-200 response
+type errStatus int
+
+func (e errStatus) Error() string {
+	return fmt.Sprintf("HTTP %d %s", int(e), http.StatusText(int(e)))
 }
 
-func readSubscriptionURLs(path string) ([]string, error) {
-	file, err := os.Open(path)
+// download fetches url within Timeout. retry reports whether a failure may be temporary:
+// network errors, timeouts, 429 and 5xx responses.
+func (f *Fetcher) download(ctx context.Context, url string) (body []byte, retry bool, err error) {
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	defer file.Close()
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
 
-	var urls []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" && !strings.HasPrefix(line, "#") {
-			urls = append(urls, line)
+	if resp.StatusCode != http.StatusOK {
+		status := resp.StatusCode
+		return nil, status == http.StatusTooManyRequests || status >= 500, errStatus(status)
+	}
+	body, err = io.ReadAll(io.LimitReader(resp.Body, maxDecodedSize+1))
+	if err != nil {
+		return nil, true, err
+	}
+	if len(body) > maxDecodedSize {
+		return nil, false, fmt.Errorf("body larger than %d MB", maxDecodedSize>>20)
+	}
+	return body, false, nil
+}
+
+// PrintSummary prints one line per subscription with its outcome
+func PrintSummary(results []Result) {
+	for i, r := range results {
+		status := "ok"
+		switch {
+		case errors.Is(r.Err, context.DeadlineExceeded):
+			status = "timed out"
+		case r.Err != nil:
+			status = r.Err.Error()
+		}
+		if r.Kept > 0 {
+			status += fmt.Sprintf(", kept %d previous rules", r.Kept)
+		}
+		format := "-"
+		if r.Err == nil {
+			format = strings.Join(append(append([]string(nil), r.Encodings...), string(r.Format)), "+")
 		}
+		fmt.Printf("%2d. %-60s %-14s rules=%-6d attempts=%d time=%-8s %s\n",
+			i+1, r.Subscription, format, len(r.Rules), r.Attempts, r.Duration.Round(time.Millisecond), status)
 	}
-	return urls, nil
 }
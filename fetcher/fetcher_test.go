@@ -0,0 +1,166 @@
+package fetcher_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"openvpnadvanced/fetcher"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fetcher", func() {
+	var (
+		server  *httptest.Server
+		hits    map[string]*atomic.Int32
+		release chan struct{}
+		f       *fetcher.Fetcher
+		dir     string
+	)
+
+	BeforeEach(func() {
+		hits = map[string]*atomic.Int32{}
+		for _, path := range []string{"/a", "/b", "/flaky", "/missing", "/hang"} {
+			hits[path] = &atomic.Int32{}
+		}
+		release = make(chan struct{})
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := hits[r.URL.Path].Add(1)
+			switch r.URL.Path {
+			case "/a":
+				_, _ = w.Write([]byte("DOMAIN-SUFFIX,a.com\nDOMAIN-SUFFIX,shared.com\n"))
+			case "/b":
+				_, _ = w.Write([]byte("DOMAIN-SUFFIX,shared.com\nDOMAIN-SUFFIX,b.com\n"))
+			case "/flaky":
+				if n < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				_, _ = w.Write([]byte("DOMAIN,flaky.com\n"))
+			case "/missing":
+				w.WriteHeader(http.StatusNotFound)
+			case "/hang":
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			}
+		}))
+
+		f = fetcher.NewFetcher()
+		f.Timeout = 200 * time.Millisecond
+		f.Backoff = time.Millisecond
+		dir = GinkgoT().TempDir()
+	})
+
+	AfterEach(func() {
+		close(release)
+		server.Close()
+	})
+
+	subscribe := func(paths ...string) string {
+		file := filepath.Join(dir, "subscriptions.txt")
+		var content string
+		for _, path := range paths {
+			content += server.URL + path + "\n"
+		}
+		Expect(os.WriteFile(file, []byte(content), 0644)).To(Succeed())
+		return file
+	}
+
+	It("merges rules in subscription order while fetching in parallel", func() {
+		out := filepath.Join(dir, "merged.list")
+		results, err := f.FetchAndMerge(context.Background(), subscribe("/hang", "/a", "/b"), out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(3))
+		Expect(errors.Is(results[0].Err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(results[1].Err).NotTo(HaveOccurred())
+		Expect(results[1].Rules).To(HaveLen(2))
+
+		merged, err := os.ReadFile(out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(merged)).To(Equal(
+			"# subscription: " + server.URL + "/hang\n" +
+				"# subscription: " + server.URL + "/a\nDOMAIN-SUFFIX,a.com\nDOMAIN-SUFFIX,shared.com\n" +
+				"# subscription: " + server.URL + "/b\nDOMAIN-SUFFIX,b.com\n"))
+	})
+
+	It("retries temporary failures with backoff", func() {
+		results := f.FetchAll(context.Background(), []fetcher.Subscription{{URL: server.URL + "/flaky"}})
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(results[0].Attempts).To(Equal(3))
+		Expect(results[0].Rules).To(Equal([]string{"DOMAIN,flaky.com"}))
+	})
+
+	It("gives up after the configured retries", func() {
+		f.Retries = 1
+		results := f.FetchAll(context.Background(), []fetcher.Subscription{{URL: server.URL + "/flaky"}})
+		Expect(results[0].Err).To(MatchError(ContainSubstring("503")))
+		Expect(results[0].Attempts).To(Equal(2))
+	})
+
+	It("does not retry a missing list", func() {
+		results := f.FetchAll(context.Background(), []fetcher.Subscription{{URL: server.URL + "/missing"}})
+		Expect(results[0].Err).To(MatchError(ContainSubstring("404")))
+		Expect(results[0].Attempts).To(Equal(1))
+	})
+
+	It("times out every attempt of a hung URL", func() {
+		f.Retries = 2
+		start := time.Now()
+		results := f.FetchAll(context.Background(), []fetcher.Subscription{{URL: server.URL + "/hang"}})
+		Expect(errors.Is(results[0].Err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(results[0].Attempts).To(Equal(3))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+	})
+
+	It("keeps the previous rules of a subscription that fails", func() {
+		out := filepath.Join(dir, "merged.list")
+		subs := subscribe("/a", "/missing")
+		Expect(os.WriteFile(out, []byte(
+			"# subscription: "+server.URL+"/a\nDOMAIN,old-a.com\n"+
+				"# subscription: "+server.URL+"/missing\nDOMAIN,old-missing.com\n"), 0644)).To(Succeed())
+
+		results, err := f.FetchAndMerge(context.Background(), subs, out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results[1].Err).To(HaveOccurred())
+		Expect(results[1].Kept).To(Equal(1))
+
+		merged, err := os.ReadFile(out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(merged)).To(ContainSubstring("DOMAIN-SUFFIX,a.com\n"))
+		Expect(string(merged)).NotTo(ContainSubstring("old-a.com"))
+		Expect(string(merged)).To(ContainSubstring("DOMAIN,old-missing.com\n"))
+
+		files, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(2)) // subscriptions.txt and merged.list, no temporary files
+	})
+
+	It("keeps a file without sections when a subscription fails", func() {
+		out := filepath.Join(dir, "merged.list")
+		Expect(os.WriteFile(out, []byte("DOMAIN,old.com\n"), 0644)).To(Succeed())
+
+		_, err := f.FetchAndMerge(context.Background(), subscribe("/a", "/missing"), out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.ReadFile(out)).To(Equal([]byte("DOMAIN,old.com\n")))
+	})
+
+	It("keeps the previous rules when every subscription fails", func() {
+		out := filepath.Join(dir, "merged.list")
+		Expect(os.WriteFile(out, []byte("DOMAIN,old.com\n"), 0644)).To(Succeed())
+
+		results, err := f.FetchAndMerge(context.Background(), subscribe("/missing"), out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results[0].Err).To(HaveOccurred())
+		Expect(os.ReadFile(out)).To(Equal([]byte("DOMAIN,old.com\n")))
+	})
+})
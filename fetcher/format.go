@@ -0,0 +1,442 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"openvpnadvanced/internal/pbscan"
+	"openvpnadvanced/ruleset"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the layout of a subscription body
+type Format string
+
+const (
+	FormatAuto    Format = ""        // detected from the body
+	FormatList    Format = "list"    // Clash/Surge rule list, one rule per line
+	FormatClash   Format = "clash"   // Clash rule-provider YAML with a payload list
+	FormatGeosite Format = "geosite" // v2ray geosite.dat; needs category names
+	FormatDnsmasq Format = "dnsmasq" // dnsmasq conf with server=/domain/ lines
+	FormatABP     Format = "abp"     // AutoProxy/Adblock Plus filters such as gfwlist
+)
+
+// ParseFormat validates a subscription format name. An empty name or "auto" means detection.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(name))); f {
+	case "auto":
+		return FormatAuto, nil
+	case FormatAuto, FormatList, FormatClash, FormatGeosite, FormatDnsmasq, FormatABP:
+		return f, nil
+	}
+	return FormatAuto, fmt.Errorf("unknown subscription format %q (want auto, list, clash, geosite, dnsmasq or abp)", name)
+}
+
+// Subscription is one line of the subscription file:
+//
+//	URL [FORMAT[:CATEGORY,...]]
+//
+// geosite needs the categories to take, e.g. "geosite:google,openai". A category may
+// carry an attribute filter such as "category-ads-all@ads".
+type Subscription struct {
+	URL        string
+	Format     Format
+	Categories []string
+}
+
+func (s Subscription) String() string {
+	if s.Format == FormatAuto {
+		return s.URL
+	}
+	if len(s.Categories) > 0 {
+		return fmt.Sprintf("%s (%s:%s)", s.URL, s.Format, strings.Join(s.Categories, ","))
+	}
+	return fmt.Sprintf("%s (%s)", s.URL, s.Format)
+}
+
+// ParseSubscription parses one line of the subscription file
+func ParseSubscription(line string) (Subscription, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Subscription{}, fmt.Errorf("want URL [FORMAT[:CATEGORY,...]], got %q", line)
+	}
+	sub := Subscription{URL: fields[0]}
+	if len(fields) == 1 {
+		return sub, nil
+	}
+
+	name, categories, _ := strings.Cut(fields[1], ":")
+	format, err := ParseFormat(name)
+	if err != nil {
+		return Subscription{}, err
+	}
+	sub.Format = format
+	for _, category := range strings.Split(categories, ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			sub.Categories = append(sub.Categories, category)
+		}
+	}
+	if len(sub.Categories) > 0 && sub.Format != FormatGeosite {
+		return Subscription{}, fmt.Errorf("categories are only used by the geosite format, got %q", fields[1])
+	}
+	return sub, nil
+}
+
+// Convert turns a subscription body, already unwrapped by Decode, into rule-list lines. Lines in a rule list are kept
+// as written; other formats become DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD, DOMAIN-REGEX
+// and IP-CIDR rules without a policy.
+func Convert(body []byte, sub Subscription) ([]string, Format, error) {
+	format := sub.Format
+	if format == FormatAuto {
+		format = DetectFormat(body, sub.URL)
+	}
+
+	var rules []string
+	var err error
+	switch format {
+	case FormatClash:
+		rules, err = convertClash(body)
+	case FormatGeosite:
+		rules, err = convertGeosite(body, sub.Categories)
+	case FormatDnsmasq:
+		rules = convertDnsmasq(body)
+	case FormatABP:
+		rules = convertABP(body)
+	default:
+		rules = convertList(body)
+	}
+	return rules, format, err
+}
+
+// DetectFormat guesses the format of a subscription body, using the URL's extension as a hint
+func DetectFormat(body []byte, url string) Format {
+	ext := strings.ToLower(path.Ext(strings.SplitN(url, "?", 2)[0]))
+	if ext == ".dat" || !utf8.Valid(body) {
+		return FormatGeosite
+	}
+	if ext == ".yaml" || ext == ".yml" {
+		return FormatClash
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "payload:"):
+			return FormatClash
+		case isDnsmasqLine(line):
+			return FormatDnsmasq
+		case isABPHeader(line), strings.HasPrefix(line, "!"):
+			return FormatABP
+		}
+		// 只看第一条有效内容
+		break
+	}
+	return FormatList
+}
+
+// convertList keeps every non-empty, non-comment line of a rule list
+func convertList(body []byte) []string {
+	var rules []string
+	for _, line := range strings.Split(string(body), "\n") {
+		rule := strings.TrimSpace(line)
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// convertClash reads the payload of a rule provider. Each entry is converted on its own,
+// so the domain, ipcidr and classical behaviours all work without being told which applies.
+func convertClash(body []byte) ([]string, error) {
+	var provider struct {
+		Payload []string `yaml:"payload"`
+	}
+	if err := yaml.Unmarshal(body, &provider); err != nil {
+		return nil, fmt.Errorf("invalid rule provider: %v", err)
+	}
+
+	var rules []string
+	for _, entry := range provider.Payload {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "" || strings.HasPrefix(entry, "#"):
+			continue
+		case strings.Contains(entry, ","):
+			// classical：本身就是一条规则
+			rules = append(rules, entry)
+		default:
+			if prefix, err := netip.ParsePrefix(entry); err == nil {
+				rules = append(rules, cidrRule(prefix))
+			} else if addr, err := netip.ParseAddr(entry); err == nil {
+				rules = append(rules, cidrRule(netip.PrefixFrom(addr, addr.BitLen())))
+			} else {
+				rules = append(rules, domainRule(entry))
+			}
+		}
+	}
+	return rules, nil
+}
+
+// domainRule converts a Clash domain-behaviour entry. "+.x", ".x" and "*.x" cover
+// subdomains and become DOMAIN-SUFFIX, which also matches x itself.
+func domainRule(entry string) string {
+	for _, wildcard := range []string{"+.", "*.", "."} {
+		if strings.HasPrefix(entry, wildcard) {
+			return string(ruleset.TypeDomainSuffix) + "," + strings.TrimPrefix(entry, wildcard)
+		}
+	}
+	return string(ruleset.TypeDomain) + "," + entry
+}
+
+func cidrRule(prefix netip.Prefix) string {
+	if prefix.Addr().Is6() {
+		return string(ruleset.TypeIPCIDR6) + "," + prefix.String()
+	}
+	return string(ruleset.TypeIPCIDR) + "," + prefix.String()
+}
+
+// isABPHeader reports whether line opens an AutoProxy or Adblock Plus list
+func isABPHeader(line string) bool {
+	return strings.HasPrefix(line, "[AutoProxy") || strings.HasPrefix(line, "[Adblock") || strings.HasPrefix(line, "||")
+}
+
+// convertABP turns AutoProxy/Adblock Plus filters, like gfwlist, into DOMAIN-SUFFIX rules
+// for the host each filter names, parsed by ruleset.ParseABPFilter. Exceptions (@@) become
+// DIRECT rules ahead of the rest, since they take priority in these lists. Filters that
+// don't name a host are skipped.
+func convertABP(body []byte) []string {
+	var exceptions, rules []string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		filter, err := ruleset.ParseABPFilter(line)
+		if err != nil {
+			continue
+		}
+
+		// 只覆盖部分 URL 的过滤器按整个主机处理：DNS 层无法区分路径
+		rule := string(ruleset.TypeDomainSuffix) + "," + filter.Host
+		if addr, err := netip.ParseAddr(filter.Host); err == nil {
+			rule = cidrRule(netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		if filter.Exception {
+			exceptions = append(exceptions, rule+","+ruleset.PolicyDirect.String())
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+	return append(exceptions, rules...)
+}
+
+// dnsmasqDirectives carry a /domain/.../ list that matches the domains and their subdomains
+var dnsmasqDirectives = []string{"server=/", "ipset=/", "nftset=/", "address=/", "local=/"}
+
+func isDnsmasqLine(line string) bool {
+	for _, directive := range dnsmasqDirectives {
+		if strings.HasPrefix(line, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// convertDnsmasq turns server=/a.com/b.com/1.2.3.4 and ipset= lines into DOMAIN-SUFFIX rules.
+// address= lines that block their domains become REJECT rules. Other directives, such as
+// local= or address= pinning an address, say nothing about routing and are skipped.
+func convertDnsmasq(body []byte) []string {
+	var rules []string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if !isDnsmasqLine(line) {
+			continue
+		}
+		directive, list, _ := strings.Cut(line, "=/")
+		domains := strings.Split(list, "/")
+		// 最后一段是上游地址、ipset 名称或 address 的应答地址
+		target := strings.TrimSpace(domains[len(domains)-1])
+
+		suffix := ""
+		switch directive {
+		case "server", "ipset":
+		case "address":
+			// 无地址、# 或全零地址表示屏蔽该域名
+			if target != "" && target != "#" && target != "0.0.0.0" && target != "::" {
+				continue
+			}
+			suffix = "," + ruleset.PolicyReject.String()
+		default:
+			continue
+		}
+		for _, domain := range domains[:len(domains)-1] {
+			if domain = strings.Trim(strings.TrimSpace(domain), "."); domain != "" && domain != "#" {
+				rules = append(rules, string(ruleset.TypeDomainSuffix)+","+domain+suffix)
+			}
+		}
+	}
+	return rules
+}
+
+// geosite.dat domain types
+const (
+	geositePlain  = 0 // keyword
+	geositeRegex  = 1
+	geositeDomain = 2 // suffix
+	geositeFull   = 3
+)
+
+// convertGeosite reads the given categories from a geosite.dat GeoSiteList. A category
+// written as name@attr only takes the domains carrying that attribute.
+func convertGeosite(body []byte, categories []string) ([]string, error) {
+	if len(categories) == 0 {
+		return nil, fmt.Errorf("geosite needs categories, e.g. geosite:google,openai")
+	}
+	wanted := make(map[string][]string) // category → attributes
+	for _, category := range categories {
+		name, attr, _ := strings.Cut(strings.ToUpper(category), "@")
+		wanted[name] = append(wanted[name], strings.ToLower(attr))
+	}
+
+	found := make(map[string][]string)
+	// GeoSiteList { repeated GeoSite entry = 1; }
+	err := pbscan.Range(body, func(f pbscan.Field) error {
+		if f.Num != 1 || f.Type != protowire.BytesType {
+			return nil
+		}
+		// GeoSite { string country_code = 1; repeated Domain domain = 2; }
+		var code string
+		var domains [][]byte
+		err := pbscan.Range(f.Bytes, func(g pbscan.Field) error {
+			switch {
+			case g.Num == 1 && g.Type == protowire.BytesType:
+				code = strings.ToUpper(string(g.Bytes))
+			case g.Num == 2 && g.Type == protowire.BytesType:
+				domains = append(domains, g.Bytes)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		attrs, ok := wanted[code]
+		if !ok {
+			return nil
+		}
+		for _, raw := range domains {
+			rule, err := geositeRule(raw, attrs)
+			if err != nil {
+				return err
+			}
+			if rule != "" {
+				found[code] = append(found[code], rule)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid geosite.dat: %v", err)
+	}
+
+	// 按配置中的类别顺序输出
+	var rules []string
+	for _, category := range categories {
+		name, _, _ := strings.Cut(strings.ToUpper(category), "@")
+		if _, ok := found[name]; !ok {
+			fmt.Printf("⚠️ geosite category %s not found\n", category)
+		}
+		rules = append(rules, found[name]...)
+		delete(found, name)
+	}
+	return rules, nil
+}
+
+// geositeRule converts one Domain message, returning "" when it lacks the wanted attributes
+func geositeRule(raw []byte, attrs []string) (string, error) {
+	// Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+	var typ uint64
+	var value string
+	var has []string
+	err := pbscan.Range(raw, func(f pbscan.Field) error {
+		switch f.Num {
+		case 1:
+			typ = f.Varint
+		case 2:
+			value = string(f.Bytes)
+		case 3:
+			// Attribute { string key = 1; ... }
+			return pbscan.Range(f.Bytes, func(a pbscan.Field) error {
+				if a.Num == 1 {
+					has = append(has, strings.ToLower(string(a.Bytes)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || value == "" {
+		return "", err
+	}
+
+	matched := false
+	for _, attr := range attrs {
+		if attr == "" || slices.Contains(has, attr) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", nil
+	}
+
+	switch typ {
+	case geositePlain:
+		return string(ruleset.TypeDomainKeyword) + "," + value, nil
+	case geositeRegex:
+		return string(ruleset.TypeDomainRegex) + "," + value, nil
+	case geositeDomain:
+		return string(ruleset.TypeDomainSuffix) + "," + value, nil
+	case geositeFull:
+		return string(ruleset.TypeDomain) + "," + value, nil
+	}
+	return "", nil
+}
+
+// readSubscriptions reads the subscription file, skipping blank lines and # comments
+func readSubscriptions(file string) ([]Subscription, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var subs []Subscription
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sub, err := ParseSubscription(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", file, n, err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, scanner.Err()
+}
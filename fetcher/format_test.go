@@ -0,0 +1,174 @@
+package fetcher_test
+
+import (
+	"openvpnadvanced/fetcher"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytesField(b []byte, num int, payload []byte) []byte {
+	b = protowire.AppendTag(b, protowire.Number(num), protowire.BytesType)
+	return protowire.AppendBytes(b, payload)
+}
+
+// geositeDomain encodes a Domain message of the given type with optional attributes
+func geositeDomain(typ uint64, value string, attrs ...string) []byte {
+	d := appendVarint(nil, 1<<3)
+	d = appendVarint(d, typ)
+	d = appendBytesField(d, 2, []byte(value))
+	for _, attr := range attrs {
+		d = appendBytesField(d, 3, appendBytesField(nil, 1, []byte(attr)))
+	}
+	return d
+}
+
+func geositeEntry(code string, domains ...[]byte) []byte {
+	entry := appendBytesField(nil, 1, []byte(code))
+	for _, d := range domains {
+		entry = appendBytesField(entry, 2, d)
+	}
+	return appendBytesField(nil, 1, entry)
+}
+
+var _ = Describe("ParseSubscription", func() {
+	DescribeTable("accepts",
+		func(line string, want fetcher.Subscription) {
+			Expect(fetcher.ParseSubscription(line)).To(Equal(want))
+		},
+		Entry("bare URL", "https://example.com/a.list", fetcher.Subscription{URL: "https://example.com/a.list"}),
+		Entry("explicit format", "https://example.com/a.txt Clash", fetcher.Subscription{URL: "https://example.com/a.txt", Format: fetcher.FormatClash}),
+		Entry("auto", "https://example.com/a.txt auto", fetcher.Subscription{URL: "https://example.com/a.txt"}),
+		Entry("geosite categories", "https://example.com/geosite.dat geosite:google,category-ads-all@ads",
+			fetcher.Subscription{URL: "https://example.com/geosite.dat", Format: fetcher.FormatGeosite, Categories: []string{"google", "category-ads-all@ads"}}),
+	)
+
+	DescribeTable("rejects",
+		func(line string) {
+			_, err := fetcher.ParseSubscription(line)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("unknown format", "https://example.com/a yaml"),
+		Entry("categories on another format", "https://example.com/a clash:google"),
+		Entry("extra fields", "https://example.com/a list extra"),
+	)
+})
+
+var _ = DescribeTable("DetectFormat",
+	func(body, url string, want fetcher.Format) {
+		Expect(fetcher.DetectFormat([]byte(body), url)).To(Equal(want))
+	},
+	Entry("rule list", "# comment\nDOMAIN-SUFFIX,x.com\n", "https://example.com/a.list", fetcher.FormatList),
+	Entry("rule provider", "# generated\npayload:\n  - '+.x.com'\n", "https://example.com/a.txt", fetcher.FormatClash),
+	Entry("yaml extension", "payload: []", "https://example.com/a.yaml?raw=1", fetcher.FormatClash),
+	Entry("dnsmasq conf", "server=/x.com/114.114.114.114\n", "https://example.com/a.conf", fetcher.FormatDnsmasq),
+	Entry("binary", "\x0a\xff\xfe", "https://example.com/download", fetcher.FormatGeosite),
+	Entry("dat extension", "", "https://example.com/geosite.dat", fetcher.FormatGeosite),
+)
+
+var _ = Describe("Convert", func() {
+	It("keeps rule-list lines as written", func() {
+		rules, format, err := fetcher.Convert([]byte("DOMAIN-SUFFIX,x.com,DIRECT\n\n# c\nIP-CIDR,1.1.1.0/24,no-resolve\n"), fetcher.Subscription{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format).To(Equal(fetcher.FormatList))
+		Expect(rules).To(Equal([]string{"DOMAIN-SUFFIX,x.com,DIRECT", "IP-CIDR,1.1.1.0/24,no-resolve"}))
+	})
+
+	It("converts every rule-provider behaviour", func() {
+		body := `payload:
+  - '+.google.com'
+  - '.youtube.com'
+  - 'chatgpt.com'
+  - 91.108.4.0/22
+  - '2001:b28:f23d::/48'
+  - 'DOMAIN-KEYWORD,telegram'
+  - IP-CIDR,149.154.160.0/20,no-resolve
+`
+		rules, format, err := fetcher.Convert([]byte(body), fetcher.Subscription{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format).To(Equal(fetcher.FormatClash))
+		Expect(rules).To(Equal([]string{
+			"DOMAIN-SUFFIX,google.com",
+			"DOMAIN-SUFFIX,youtube.com",
+			"DOMAIN,chatgpt.com",
+			"IP-CIDR,91.108.4.0/22",
+			"IP-CIDR6,2001:b28:f23d::/48",
+			"DOMAIN-KEYWORD,telegram",
+			"IP-CIDR,149.154.160.0/20,no-resolve",
+		}))
+	})
+
+	It("reports a malformed rule provider", func() {
+		_, _, err := fetcher.Convert([]byte("payload: [unterminated"), fetcher.Subscription{Format: fetcher.FormatClash})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("converts dnsmasq conf domains to suffix rules", func() {
+		body := "# china list\nserver=/baidu.com/114.114.114.114\nipset=/qq.com/.weixin.qq.com/chnroute\nno-resolv\n"
+		rules, format, err := fetcher.Convert([]byte(body), fetcher.Subscription{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format).To(Equal(fetcher.FormatDnsmasq))
+		Expect(rules).To(Equal([]string{"DOMAIN-SUFFIX,baidu.com", "DOMAIN-SUFFIX,qq.com", "DOMAIN-SUFFIX,weixin.qq.com"}))
+	})
+
+	It("converts blocking dnsmasq address lines to REJECT rules", func() {
+		body := "address=/ads.example/\naddress=/track.example/0.0.0.0\naddress=/pixel.example/#\naddress=/nas.lan/192.168.1.2\n"
+		rules, _, err := fetcher.Convert([]byte(body), fetcher.Subscription{Format: fetcher.FormatDnsmasq})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(Equal([]string{
+			"DOMAIN-SUFFIX,ads.example,REJECT",
+			"DOMAIN-SUFFIX,track.example,REJECT",
+			"DOMAIN-SUFFIX,pixel.example,REJECT",
+		}))
+	})
+
+	It("skips dnsmasq directives that do not route", func() {
+		body := "local=/lan/\nnftset=/qq.com/4#inet#fw#vpn\nserver=/corp.example/10.0.0.1\n"
+		rules, _, err := fetcher.Convert([]byte(body), fetcher.Subscription{Format: fetcher.FormatDnsmasq})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(Equal([]string{"DOMAIN-SUFFIX,corp.example"}))
+	})
+
+	Describe("geosite", func() {
+		var body []byte
+
+		BeforeEach(func() {
+			body = append(geositeEntry("GOOGLE",
+				geositeDomain(2, "google.com"),
+				geositeDomain(3, "www.google.cn", "cn"),
+				geositeDomain(0, "googleapis"),
+				geositeDomain(1, `^gstatic\d+\.com$`),
+			), geositeEntry("OPENAI", geositeDomain(2, "openai.com"))...)
+			body = append(body, geositeEntry("CN", geositeDomain(2, "cn"))...)
+		})
+
+		It("takes the listed categories in order", func() {
+			rules, _, err := fetcher.Convert(body, fetcher.Subscription{URL: "https://example.com/geosite.dat", Categories: []string{"openai", "google"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(Equal([]string{
+				"DOMAIN-SUFFIX,openai.com",
+				"DOMAIN-SUFFIX,google.com",
+				"DOMAIN,www.google.cn",
+				"DOMAIN-KEYWORD,googleapis",
+				`DOMAIN-REGEX,^gstatic\d+\.com$`,
+			}))
+		})
+
+		It("filters by attribute", func() {
+			rules, _, err := fetcher.Convert(body, fetcher.Subscription{Format: fetcher.FormatGeosite, Categories: []string{"google@cn"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(Equal([]string{"DOMAIN,www.google.cn"}))
+		})
+
+		It("needs categories", func() {
+			_, _, err := fetcher.Convert(body, fetcher.Subscription{Format: fetcher.FormatGeosite})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"os"
 	"strings"
+
+	"openvpnadvanced/ruleset"
 )
 
 // ParseRules 读取规则文件并返回规则列表
@@ -26,15 +28,20 @@ func ParseRules(path string) ([]string, error) {
 	return rules, scanner.Err()
 }
 
-// MatchRule 判断一个域名是否匹配规则列表
-func MatchRule(domain string, rules []string) bool {
-	for _, rule := range rules {
-		if strings.HasPrefix(rule, "DOMAIN-SUFFIX,") {
-			suffix := strings.TrimPrefix(rule, "DOMAIN-SUFFIX,")
-			if strings.HasSuffix(domain, suffix) {
-				return true
-			}
+// CompileRules 解析规则列表并编译，供重复匹配使用；无法识别的规则被跳过
+func CompileRules(rules []string) ruleset.Matcher {
+	var parsed []ruleset.Rule
+	for _, line := range rules {
+		if rule, err := ruleset.ParseRule(line); err == nil {
+			parsed = append(parsed, rule)
 		}
 	}
-	return false
+	return ruleset.Compile(parsed)
+}
+
+// MatchRule 判断一个域名按规则列表（首个命中的规则生效）是否走 VPN
+//
+// Deprecated: 每次调用都会重新编译规则；请用 CompileRules 编译一次后调用 ruleset.Decide。
+func MatchRule(domain string, rules []string) bool {
+	return ruleset.Decide(CompileRules(rules), domain) == ruleset.PolicyVPN
 }
@@ -0,0 +1,16 @@
+package fetcher_test
+
+import (
+	"openvpnadvanced/fetcher"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MatchRule", func() {
+	It("decides through the compiled rule list", func() {
+		rules := []string{"DOMAIN,maps.google.com,DIRECT", "DOMAIN-SUFFIX,google.com", "# comment"}
+		Expect(fetcher.MatchRule("mail.google.com", rules)).To(BeTrue())
+		Expect(fetcher.MatchRule("maps.google.com", rules)).To(BeFalse())
+	})
+})
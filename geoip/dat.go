@@ -0,0 +1,165 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"openvpnadvanced/internal/pbscan"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Dat is a v2ray geoip.dat database: a GeoIPList of named CIDR lists. Lists are decoded
+// the first time they are used, so only the countries the rules mention cost memory.
+type Dat struct {
+	mu      sync.Mutex
+	raw     map[string][]byte // encoded GeoIP message per code
+	decoded map[string]*cidrList
+}
+
+// cidrList holds the networks of one list sorted by address, with nested networks removed
+type cidrList struct {
+	v4, v6  []netip.Prefix
+	reverse bool
+}
+
+// NewDat reads a geoip.dat database from its file contents
+func NewDat(buf []byte) (*Dat, error) {
+	d := &Dat{raw: make(map[string][]byte), decoded: make(map[string]*cidrList)}
+	// GeoIPList { repeated GeoIP entry = 1; }
+	err := pbscan.Range(buf, func(f pbscan.Field) error {
+		if f.Num != 1 || f.Type != protowire.BytesType {
+			return nil
+		}
+		var code string
+		// GeoIP { string country_code = 1; repeated CIDR cidr = 2; bool reverse_match = 3; }
+		err := pbscan.Range(f.Bytes, func(g pbscan.Field) error {
+			if g.Num == 1 && g.Type == protowire.BytesType {
+				code = normalizeCode(string(g.Bytes))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if code != "" {
+			d.raw[code] = f.Bytes
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	if len(d.raw) == 0 {
+		return nil, fmt.Errorf("%w: no GeoIP lists", errCorrupt)
+	}
+	return d, nil
+}
+
+// Contains reports whether addr is in the list named code
+func (d *Dat) Contains(code string, addr netip.Addr) bool {
+	list := d.list(normalizeCode(code))
+	if list == nil {
+		return false
+	}
+	return list.contains(addr.Unmap()) != list.reverse
+}
+
+// list returns the decoded list for code, or nil when the database has no such list
+func (d *Dat) list(code string) *cidrList {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if list, ok := d.decoded[code]; ok {
+		return list
+	}
+	raw, ok := d.raw[code]
+	if !ok {
+		return nil
+	}
+	// 损坏的列表按不存在处理，并且只解码一次
+	list, err := decodeList(raw)
+	if err != nil {
+		list = nil
+	}
+	d.decoded[code] = list
+	return list
+}
+
+func decodeList(raw []byte) (*cidrList, error) {
+	list := &cidrList{}
+	err := pbscan.Range(raw, func(f pbscan.Field) error {
+		switch {
+		case f.Num == 2 && f.Type == protowire.BytesType:
+			// CIDR { bytes ip = 1; uint32 prefix = 2; }
+			var ip []byte
+			var bits uint64
+			err := pbscan.Range(f.Bytes, func(c pbscan.Field) error {
+				switch c.Num {
+				case 1:
+					ip = c.Bytes
+				case 2:
+					bits = c.Varint
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			addr, ok := netip.AddrFromSlice(ip)
+			if !ok {
+				return fmt.Errorf("invalid address of %d bytes", len(ip))
+			}
+			prefix := netip.PrefixFrom(addr, int(bits)).Masked()
+			if !prefix.IsValid() {
+				return fmt.Errorf("invalid prefix %s/%d", addr, bits)
+			}
+			if addr.Is4() {
+				list.v4 = append(list.v4, prefix)
+			} else {
+				list.v6 = append(list.v6, prefix)
+			}
+			return nil
+		case f.Num == 3 && f.Type == protowire.VarintType:
+			list.reverse = f.Varint != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	list.v4 = flatten(list.v4)
+	list.v6 = flatten(list.v6)
+	return list, nil
+}
+
+// flatten sorts prefixes by address and drops those inside an earlier one. CIDR blocks
+// either nest or are disjoint, so what remains is a sorted list of disjoint networks.
+func flatten(prefixes []netip.Prefix) []netip.Prefix {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+	out := prefixes[:0]
+	for _, p := range prefixes {
+		if n := len(out); n > 0 && out[n-1].Contains(p.Addr()) {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+func (l *cidrList) contains(addr netip.Addr) bool {
+	prefixes := l.v6
+	if addr.Is4() {
+		prefixes = l.v4
+	}
+	// 二分查找起始地址不大于 addr 的最后一个网段
+	i := sort.Search(len(prefixes), func(i int) bool { return prefixes[i].Addr().Compare(addr) > 0 })
+	return i > 0 && prefixes[i-1].Contains(addr)
+}
@@ -0,0 +1,87 @@
+package geoip_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"openvpnadvanced/geoip"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytesField(b []byte, num int, payload []byte) []byte {
+	b = protowire.AppendTag(b, protowire.Number(num), protowire.BytesType)
+	return protowire.AppendBytes(b, payload)
+}
+
+// geoIPEntry encodes a GeoIP message with the given networks
+func geoIPEntry(code string, reverse bool, prefixes ...string) []byte {
+	entry := appendBytesField(nil, 1, []byte(code))
+	for _, s := range prefixes {
+		p := netip.MustParsePrefix(s)
+		cidr := appendBytesField(nil, 1, p.Addr().AsSlice())
+		cidr = appendVarint(cidr, 2<<3)
+		cidr = appendVarint(cidr, uint64(p.Bits()))
+		entry = appendBytesField(entry, 2, cidr)
+	}
+	if reverse {
+		entry = appendVarint(entry, 3<<3)
+		entry = appendVarint(entry, 1)
+	}
+	return entry
+}
+
+var _ = Describe("Dat", func() {
+	var db *geoip.Dat
+
+	BeforeEach(func() {
+		var list []byte
+		list = appendBytesField(list, 1, geoIPEntry("CN", false, "1.0.1.0/24", "1.0.0.0/16", "36.0.0.0/8", "240e::/20"))
+		list = appendBytesField(list, 1, geoIPEntry("private", false, "10.0.0.0/8", "192.168.0.0/16"))
+		list = appendBytesField(list, 1, geoIPEntry("NOT-CN", true, "1.0.0.0/16", "36.0.0.0/8"))
+
+		var err error
+		db, err = geoip.NewDat(list)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("Contains",
+		func(code, ip string, want bool) {
+			Expect(db.Contains(code, netip.MustParseAddr(ip))).To(Equal(want))
+		},
+		Entry("inside a nested network", "CN", "1.0.1.1", true),
+		Entry("inside the enclosing network", "CN", "1.0.200.1", true),
+		Entry("last network", "CN", "36.255.255.255", true),
+		Entry("IPv6", "CN", "240e:1::1", true),
+		Entry("IPv4-mapped address", "CN", "::ffff:36.1.1.1", true),
+		Entry("outside", "CN", "8.8.8.8", false),
+		Entry("before the first network", "CN", "0.0.0.1", false),
+		Entry("lists other than countries, case-insensitive", "PRIVATE", "192.168.1.1", true),
+		Entry("reverse match", "NOT-CN", "8.8.8.8", true),
+		Entry("reverse match excludes its networks", "NOT-CN", "36.1.1.1", false),
+		Entry("unknown list", "US", "8.8.8.8", false),
+	)
+
+	It("is detected by Open", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "geoip.dat")
+		Expect(os.WriteFile(path, appendBytesField(nil, 1, geoIPEntry("CN", false, "1.0.1.0/24")), 0644)).To(Succeed())
+
+		opened, err := geoip.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(opened).To(BeAssignableToTypeOf(&geoip.Dat{}))
+		Expect(opened.Contains("cn", netip.MustParseAddr("1.0.1.1"))).To(BeTrue())
+	})
+
+	It("rejects a file that is neither format", func() {
+		_, err := geoip.NewDat([]byte{0xff, 0xff})
+		Expect(err).To(HaveOccurred())
+	})
+})
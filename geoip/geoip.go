@@ -0,0 +1,58 @@
+// Package geoip answers which country an address belongs to from an offline
+// MaxMind MMDB or v2ray geoip.dat database.
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// DefaultPaths are tried in order when no database is configured
+var DefaultPaths = []string{"assets/Country.mmdb", "assets/GeoLite2-Country.mmdb", "assets/geoip.dat"}
+
+// DB is a loaded GeoIP database
+type DB interface {
+	// Contains reports whether addr belongs to the country with the given ISO code. For
+	// geoip.dat the code may also name one of its other lists, such as PRIVATE.
+	Contains(code string, addr netip.Addr) bool
+}
+
+// Find returns the first of DefaultPaths that exists
+func Find() (string, error) {
+	for _, path := range DefaultPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("none of %s found: %w", strings.Join(DefaultPaths, ", "), fs.ErrNotExist)
+}
+
+// Open loads the database at path, telling MMDB and geoip.dat files apart by their content
+func Open(path string) (DB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var db DB
+	if bytes.Contains(data, metadataMarker) {
+		db, err = NewMMDB(data)
+	} else {
+		db, err = NewDat(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+var errCorrupt = errors.New("corrupt GeoIP database")
+
+// normalizeCode upper-cases a country or list code
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
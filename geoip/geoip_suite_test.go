@@ -0,0 +1,13 @@
+package geoip_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestGeoip(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Geoip Suite")
+}
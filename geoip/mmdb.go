@@ -0,0 +1,71 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// metadataMarker precedes the metadata map at the end of an MMDB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MMDB is a MaxMind DB, such as GeoLite2-Country, held in memory
+type MMDB struct {
+	reader *maxminddb.Reader
+	codes  sync.Map // record offset -> country code
+}
+
+// countryRecord holds the only fields Country needs; the decoder skips the rest
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// NewMMDB reads a MaxMind DB from its file contents
+func NewMMDB(buf []byte) (*MMDB, error) {
+	reader, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	return &MMDB{reader: reader}, nil
+}
+
+// Country returns the ISO code of the country addr is located in, or of the country it
+// is registered to when the location is unknown. It is empty when addr is not listed.
+func (m *MMDB) Country(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.Is6() && m.reader.Metadata.IPVersion != 6 {
+		return ""
+	}
+	off, err := m.reader.LookupOffset(net.IP(addr.AsSlice()))
+	if err != nil || off == maxminddb.NotFound {
+		return ""
+	}
+	// 同一国家的地址段共用一条记录，按偏移缓存避免重复解码
+	if code, ok := m.codes.Load(off); ok {
+		return code.(string)
+	}
+	var record countryRecord
+	if err := m.reader.Decode(off, &record); err != nil {
+		return ""
+	}
+	code := record.Country.ISOCode
+	if code == "" {
+		code = record.RegisteredCountry.ISOCode
+	}
+	m.codes.Store(off, code)
+	return code
+}
+
+// Contains reports whether addr is located in the country with the given ISO code
+func (m *MMDB) Contains(code string, addr netip.Addr) bool {
+	country := m.Country(addr)
+	return country != "" && country == normalizeCode(code)
+}
@@ -0,0 +1,206 @@
+package geoip_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"openvpnadvanced/geoip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// mmdbBuilder writes a minimal IPv6 MaxMind DB with 24, 28 or 32-bit records
+type mmdbBuilder struct {
+	nodes      [][2]int // child node, or -1 for none, or -2-offset for a data record
+	data       []byte
+	recordSize int
+}
+
+func newMMDBBuilder() *mmdbBuilder {
+	return &mmdbBuilder{nodes: [][2]int{{-1, -1}}, recordSize: 24}
+}
+
+// insert points prefix at the record starting at offset in the data section
+func (b *mmdbBuilder) insert(prefix netip.Prefix, offset int) {
+	// IPv4 networks live under ::/96
+	var ip [16]byte
+	bits := prefix.Bits()
+	if a := prefix.Addr(); a.Is4() {
+		v4 := a.As4()
+		copy(ip[12:], v4[:])
+		bits += 96
+	} else {
+		ip = a.As16()
+	}
+	node := 0
+	for i := 0; i < bits; i++ {
+		bit := int(ip[i/8]>>(7-i%8)) & 1
+		if i == bits-1 {
+			b.nodes[node][bit] = -2 - offset
+			return
+		}
+		if b.nodes[node][bit] < 0 {
+			b.nodes = append(b.nodes, [2]int{-1, -1})
+			b.nodes[node][bit] = len(b.nodes) - 1
+		}
+		node = b.nodes[node][bit]
+	}
+}
+
+func (b *mmdbBuilder) bytes() []byte {
+	count := len(b.nodes)
+	var out []byte
+	for _, node := range b.nodes {
+		var v [2]uint32
+		for i, rec := range node {
+			switch {
+			case rec == -1:
+				v[i] = uint32(count)
+			case rec < -1:
+				v[i] = uint32(count + 16 + (-2 - rec))
+			default:
+				v[i] = uint32(rec)
+			}
+		}
+		switch b.recordSize {
+		case 24:
+			out = append(out, byte(v[0]>>16), byte(v[0]>>8), byte(v[0]), byte(v[1]>>16), byte(v[1]>>8), byte(v[1]))
+		case 28:
+			// 中间字节的高 4 位属于左记录，低 4 位属于右记录
+			out = append(out, byte(v[0]>>16), byte(v[0]>>8), byte(v[0]), byte(v[0]>>24)<<4|byte(v[1]>>24)&0x0f,
+				byte(v[1]>>16), byte(v[1]>>8), byte(v[1]))
+		default:
+			out = binary.BigEndian.AppendUint32(out, v[0])
+			out = binary.BigEndian.AppendUint32(out, v[1])
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, b.data...)
+	out = append(out, "\xab\xcd\xefMaxMind.com"...)
+	out = append(out, mmdbMap(4)...)
+	out = append(out, mmdbString("binary_format_major_version")...)
+	out = append(out, mmdbUint(5, 2)...)
+	out = append(out, mmdbString("node_count")...)
+	out = append(out, mmdbUint(6, uint32(count))...)
+	out = append(out, mmdbString("record_size")...)
+	out = append(out, mmdbUint(5, uint32(b.recordSize))...)
+	out = append(out, mmdbString("ip_version")...)
+	out = append(out, mmdbUint(5, 6)...)
+	return out
+}
+
+func mmdbMap(size int) []byte { return []byte{7<<5 | byte(size)} }
+
+func mmdbString(s string) []byte { return append([]byte{2<<5 | byte(len(s))}, s...) }
+
+// mmdbUint encodes v as a uint16 (type 5) or uint32 (type 6)
+func mmdbUint(typ byte, v uint32) []byte {
+	if typ == 5 {
+		return []byte{typ<<5 | 2, byte(v >> 8), byte(v)}
+	}
+	return []byte{typ<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// countryRecord encodes {key: {iso_code: code}}
+func countryRecord(key, code string) []byte {
+	out := mmdbMap(1)
+	out = append(out, mmdbString(key)...)
+	out = append(out, mmdbMap(1)...)
+	out = append(out, mmdbString("iso_code")...)
+	return append(out, mmdbString(code)...)
+}
+
+var _ = Describe("MMDB", func() {
+	var db *geoip.MMDB
+
+	for _, size := range []int{24, 28, 32} {
+		It(fmt.Sprintf("reads %d-bit records", size), func() {
+			b := newMMDBBuilder()
+			b.recordSize = size
+			b.insert(netip.MustParsePrefix("1.0.1.0/24"), 0)
+			b.data = countryRecord("country", "CN")
+			b.insert(netip.MustParsePrefix("2001:db8::/32"), len(b.data))
+			b.data = append(b.data, countryRecord("country", "DE")...)
+
+			db, err := geoip.NewMMDB(b.bytes())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(db.Country(netip.MustParseAddr("1.0.1.1"))).To(Equal("CN"))
+			Expect(db.Country(netip.MustParseAddr("2001:db8::1"))).To(Equal("DE"))
+			Expect(db.Country(netip.MustParseAddr("1.0.2.1"))).To(BeEmpty())
+		})
+	}
+
+	It("reads 28-bit records that use the shared middle nibble", func() {
+		b := newMMDBBuilder()
+		b.recordSize = 28
+		// 数据偏移超过 24 位，左右记录都要用到中间字节
+		b.data = make([]byte, 1<<24)
+		b.insert(netip.MustParsePrefix("0.0.0.0/1"), len(b.data))
+		b.data = append(b.data, countryRecord("country", "CN")...)
+		b.insert(netip.MustParsePrefix("128.0.0.0/1"), len(b.data))
+		b.data = append(b.data, countryRecord("country", "US")...)
+
+		db, err := geoip.NewMMDB(b.bytes())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(db.Country(netip.MustParseAddr("1.1.1.1"))).To(Equal("CN"))
+		Expect(db.Country(netip.MustParseAddr("200.1.1.1"))).To(Equal("US"))
+	})
+
+	BeforeEach(func() {
+		b := newMMDBBuilder()
+		cn := countryRecord("country", "CN")
+		b.insert(netip.MustParsePrefix("1.0.1.0/24"), 0)
+		b.data = append(b.data, cn...)
+
+		// 同一数据通过指针复用
+		b.insert(netip.MustParsePrefix("1.0.8.0/21"), len(b.data))
+		b.data = append(b.data, 1<<5, 0)
+
+		b.insert(netip.MustParsePrefix("2001:db8::/32"), len(b.data))
+		b.data = append(b.data, countryRecord("registered_country", "DE")...)
+
+		var err error
+		db, err = geoip.NewMMDB(b.bytes())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("Country",
+		func(ip, want string) {
+			Expect(db.Country(netip.MustParseAddr(ip))).To(Equal(want))
+		},
+		Entry("IPv4 in an IPv6 tree", "1.0.1.1", "CN"),
+		Entry("IPv4-mapped address", "::ffff:1.0.1.1", "CN"),
+		Entry("record reached through a pointer", "1.0.15.255", "CN"),
+		Entry("registered country when the location is unknown", "2001:db8::1", "DE"),
+		Entry("not listed", "8.8.8.8", ""),
+		Entry("IPv6 not listed", "2001:4860::8888", ""),
+	)
+
+	It("matches country codes case-insensitively", func() {
+		Expect(db.Contains("cn", netip.MustParseAddr("1.0.1.1"))).To(BeTrue())
+		Expect(db.Contains("US", netip.MustParseAddr("1.0.1.1"))).To(BeFalse())
+		Expect(db.Contains("CN", netip.MustParseAddr("8.8.8.8"))).To(BeFalse())
+	})
+
+	It("is detected by Open", func() {
+		b := newMMDBBuilder()
+		b.insert(netip.MustParsePrefix("1.0.1.0/24"), 0)
+		b.data = countryRecord("country", "CN")
+		path := filepath.Join(GinkgoT().TempDir(), "Country.mmdb")
+		Expect(os.WriteFile(path, b.bytes(), 0644)).To(Succeed())
+
+		opened, err := geoip.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(opened).To(BeAssignableToTypeOf(&geoip.MMDB{}))
+		Expect(opened.Contains("CN", netip.MustParseAddr("1.0.1.200"))).To(BeTrue())
+	})
+
+	It("rejects a file without metadata", func() {
+		_, err := geoip.NewMMDB([]byte("not a database"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,54 @@
+// Package pbscan walks the fields of a protocol buffer message, enough to read
+// data files such as v2ray's geoip.dat without generated code. Decoding is done by
+// google.golang.org/protobuf/encoding/protowire.
+package pbscan
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field is a single field of a message. Varint holds the value of varint and fixed
+// fields, Bytes the payload of length-delimited ones.
+type Field struct {
+	Num    protowire.Number
+	Type   protowire.Type
+	Varint uint64
+	Bytes  []byte
+}
+
+// Range calls fn for each field of msg in order, stopping at the first error
+func Range(msg []byte, fn func(Field) error) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		f := Field{Num: num, Type: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.Varint, n = protowire.ConsumeVarint(msg)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(msg)
+			f.Varint = uint64(v)
+		case protowire.Fixed64Type:
+			f.Varint, n = protowire.ConsumeFixed64(msg)
+		case protowire.BytesType:
+			f.Bytes, n = protowire.ConsumeBytes(msg)
+		default:
+			// 分组等其他类型整体跳过
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
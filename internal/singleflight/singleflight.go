@@ -0,0 +1,20 @@
+// Package singleflight wraps golang.org/x/sync/singleflight with typed results.
+package singleflight
+
+import "golang.org/x/sync/singleflight"
+
+// Group runs at most one function per key at a time. Callers arriving while it is
+// in flight wait for it and receive the same result.
+type Group[V any] struct {
+	group singleflight.Group
+}
+
+// Do executes fn for key unless a call for key is already running, in which case it
+// waits for that call. shared reports whether the result was given to more than one caller.
+func (g *Group[V]) Do(key string, fn func() (V, error)) (v V, err error, shared bool) {
+	val, err, shared := g.group.Do(key, func() (any, error) {
+		return fn()
+	})
+	v, _ = val.(V)
+	return v, err, shared
+}
@@ -0,0 +1,174 @@
+package ruleset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// hostsAliases are names found in hosts files that describe the machine itself, not ads
+var hostsAliases = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// ParseBlocklist reads an ad/tracker blocklist into REJECT rules. It accepts adblock
+// filters (||ads.example.com^ blocks the name and its subdomains), hosts files
+// (0.0.0.0 ads.example.com) and Clash/Surge domain rules, whose policy defaults to REJECT.
+// Other filter syntax, including @@ exceptions, is reported as unsupported, and so are
+// rules with another policy, which would override the user's rules, and IP rules, which
+// the DNS proxy cannot enforce.
+func ParseBlocklist(r io.Reader) ([]Rule, []*ParseError, error) {
+	var rules []Rule
+	var unsupported []*ParseError
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		parsed, err := parseBlockLine(line)
+		if err != nil {
+			unsupported = append(unsupported, &ParseError{Line: n, Text: line, Err: err})
+			continue
+		}
+		rules = append(rules, parsed...)
+	}
+	return rules, unsupported, scanner.Err()
+}
+
+// ParseBlocklistFile is ParseBlocklist for a list on disk
+func ParseBlocklistFile(path string) ([]Rule, []*ParseError, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return ParseBlocklist(file)
+}
+
+// ABPFilter is the host an AutoProxy or Adblock Plus network filter applies to
+type ABPFilter struct {
+	Host      string // lower-case domain name or IP address
+	Exception bool   // an @@ filter, exempting the host
+	Partial   bool   // the filter names a path, port or URL prefix, so it covers only part of the host
+}
+
+// ParseABPFilter extracts the host from a filter such as ||x.com^, |https://x.com/path,
+// .x.com or x.com/path. Regex and cosmetic filters, filters with $options, which limit
+// them to some requests, and hosts with wildcards cannot become domain rules and are
+// reported as errors.
+func ParseABPFilter(line string) (ABPFilter, error) {
+	var f ABPFilter
+	filter, exception := strings.CutPrefix(strings.TrimSpace(line), "@@")
+	f.Exception = exception
+	switch {
+	case strings.HasPrefix(filter, "/"):
+		// 正则过滤器匹配的是 URL，无法转换为域名规则
+		return f, fmt.Errorf("regex filters are not supported")
+	case strings.Contains(filter, "##") || strings.Contains(filter, "#@#") || strings.Contains(filter, "#?#"):
+		return f, fmt.Errorf("cosmetic filters are not supported")
+	case strings.Contains(filter, "$"):
+		return f, fmt.Errorf("filter options are not supported")
+	}
+
+	filter = strings.TrimLeft(filter, "|")
+	if scheme := strings.Index(filter, "://"); scheme >= 0 {
+		filter = filter[scheme+3:]
+	}
+	filter = strings.TrimPrefix(filter, "*.")
+	filter = strings.TrimPrefix(filter, ".")
+	host := filter
+	if end := strings.IndexAny(filter, "/^:?|*"); end >= 0 {
+		// ^、| 和末尾的 / 只是分隔符，其余内容说明过滤器只覆盖部分 URL
+		host, f.Partial = filter[:end], strings.Trim(filter[end:], "^|/") != ""
+	}
+	f.Host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if _, err := netip.ParseAddr(f.Host); err == nil {
+		return f, nil
+	}
+	if !strings.Contains(f.Host, ".") {
+		return f, fmt.Errorf("%q has no domain name", line)
+	}
+	for _, c := range f.Host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-') {
+			return f, fmt.Errorf("%q has no domain name", line)
+		}
+	}
+	return f, nil
+}
+
+func parseBlockLine(line string) ([]Rule, error) {
+	// adblock 语法：||domain^ 屏蔽该域名及子域名
+	if strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "|") {
+		f, err := ParseABPFilter(line)
+		switch {
+		case err != nil:
+			return nil, err
+		case f.Exception:
+			return nil, fmt.Errorf("exception filters are not supported")
+		case f.Partial:
+			return nil, fmt.Errorf("filters for part of a site are not supported")
+		}
+		if _, err := netip.ParseAddr(f.Host); err == nil {
+			return nil, fmt.Errorf("filters for addresses cannot be blocked at the DNS layer")
+		}
+		rule, err := parseRule(string(TypeDomainSuffix)+","+f.Host, PolicyReject)
+		if err != nil {
+			return nil, err
+		}
+		return []Rule{rule}, nil
+	}
+
+	// hosts 文件：地址后跟一个或多个主机名，行尾可带注释
+	fields := strings.Fields(line)
+	if addr, err := netip.ParseAddr(fields[0]); err == nil {
+		if !addr.IsUnspecified() && !addr.IsLoopback() {
+			return nil, fmt.Errorf("hosts entry for %s does not block", addr)
+		}
+		var rules []Rule
+		for _, name := range fields[1:] {
+			if strings.HasPrefix(name, "#") {
+				break
+			}
+			if hostsAliases[strings.ToLower(name)] {
+				continue
+			}
+			rule, err := parseRule(string(TypeDomain)+","+name, PolicyReject)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+		return rules, nil
+	}
+
+	// Clash/Surge 规则：未写策略时视为 REJECT，只接受屏蔽域名的规则
+	rule, err := parseRule(line, PolicyReject)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case rule.Type == TypeIPCIDR || rule.Type == TypeIPCIDR6 || rule.Type == TypeGeoIP:
+		return nil, fmt.Errorf("%s rules cannot be blocked at the DNS layer", rule.Type)
+	case rule.Policy != PolicyReject:
+		return nil, fmt.Errorf("blocklist rules can only REJECT, not %s", rule.Policy)
+	}
+	return []Rule{rule}, nil
+}
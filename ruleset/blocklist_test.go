@@ -0,0 +1,101 @@
+package ruleset_test
+
+import (
+	"strings"
+
+	"openvpnadvanced/ruleset"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseBlocklist", func() {
+	parse := func(lines ...string) ([]ruleset.Rule, []*ruleset.ParseError) {
+		rules, unsupported, err := ruleset.ParseBlocklist(strings.NewReader(strings.Join(lines, "\n")))
+		Expect(err).NotTo(HaveOccurred())
+		return rules, unsupported
+	}
+
+	It("turns adblock filters into REJECT suffix rules", func() {
+		rules, unsupported := parse("[Adblock Plus 2.0]", "! Title: test", "||ads.example.com^", "||Tracker.Example.NET^")
+		Expect(unsupported).To(BeEmpty())
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[0].String()).To(Equal("DOMAIN-SUFFIX,ads.example.com,REJECT"))
+		Expect(rules[1].Value).To(Equal("tracker.example.net"))
+	})
+
+	It("turns hosts entries into REJECT rules for the exact names", func() {
+		rules, unsupported := parse(
+			"127.0.0.1 localhost",
+			"::1 ip6-localhost ip6-loopback",
+			"0.0.0.0 0.0.0.0",
+			"0.0.0.0 ads.example.com banner.example.com # two names",
+			"127.0.0.1\tpixel.example.org",
+		)
+		Expect(unsupported).To(BeEmpty())
+		Expect(rules).To(HaveLen(3))
+		for _, rule := range rules {
+			Expect(rule.Type).To(Equal(ruleset.TypeDomain))
+			Expect(rule.Policy).To(Equal(ruleset.PolicyReject))
+		}
+		Expect(rules[2].Value).To(Equal("pixel.example.org"))
+	})
+
+	It("defaults rule-list lines to REJECT", func() {
+		rules, unsupported := parse("DOMAIN-KEYWORD,doubleclick", "DOMAIN-SUFFIX,ads.example.com,REJECT")
+		Expect(unsupported).To(BeEmpty())
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[0].Policy).To(Equal(ruleset.PolicyReject))
+		Expect(rules[1].Policy).To(Equal(ruleset.PolicyReject))
+	})
+
+	It("reports rules with another policy and IP rules", func() {
+		rules, unsupported := parse(
+			"DOMAIN,ok.example.com,DIRECT",
+			"DOMAIN-SUFFIX,corp.example,VPN",
+			"IP-CIDR,192.0.2.0/24,no-resolve",
+			"IP-CIDR6,2001:db8::/32,REJECT",
+			"DOMAIN,ads.example.com",
+		)
+		Expect(rules).To(HaveLen(1))
+		Expect(rules[0].Value).To(Equal("ads.example.com"))
+		Expect(unsupported).To(HaveLen(4))
+	})
+
+	It("reports filters it cannot apply at the DNS layer", func() {
+		rules, unsupported := parse(
+			"||ads.example.com^",
+			"@@||good.example.com^",
+			"||example.com/banner/*",
+			"||example.com^$third-party",
+			"example.com##.ad-banner",
+			"192.0.2.1 intranet.example.com",
+		)
+		Expect(rules).To(HaveLen(1))
+		Expect(unsupported).To(HaveLen(5))
+		Expect(unsupported[0].Line).To(Equal(2))
+	})
+})
+
+var _ = DescribeTable("ParseABPFilter",
+	func(line string, want ruleset.ABPFilter, ok bool) {
+		filter, err := ruleset.ParseABPFilter(line)
+		if !ok {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filter).To(Equal(want))
+	},
+	Entry("domain anchor", "||Ads.Example.com^", ruleset.ABPFilter{Host: "ads.example.com"}, true),
+	Entry("domain anchor without separator", "||google.com", ruleset.ABPFilter{Host: "google.com"}, true),
+	Entry("URL prefix", "|https://www.example.org/path", ruleset.ABPFilter{Host: "www.example.org", Partial: true}, true),
+	Entry("leading dot", ".twitter.com", ruleset.ABPFilter{Host: "twitter.com"}, true),
+	Entry("path", "youtube.com/watch", ruleset.ABPFilter{Host: "youtube.com", Partial: true}, true),
+	Entry("address", "|http://8.8.8.8", ruleset.ABPFilter{Host: "8.8.8.8"}, true),
+	Entry("exception", "@@||cn.example.org^", ruleset.ABPFilter{Host: "cn.example.org", Exception: true}, true),
+	Entry("options", "||example.com^$third-party", ruleset.ABPFilter{}, false),
+	Entry("regex", `/^https?:\/\/[^\/]+blogspot\.(.*)/`, ruleset.ABPFilter{}, false),
+	Entry("cosmetic", "example.com##.ad-banner", ruleset.ABPFilter{}, false),
+	Entry("wildcard", "||google.*", ruleset.ABPFilter{}, false),
+)
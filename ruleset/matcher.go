@@ -0,0 +1,126 @@
+package ruleset
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Matcher finds the rules covering a domain in a compiled rule list
+type Matcher interface {
+	// Match reports whether any domain rule matches
+	Match(domain string) bool
+	// Lookup returns the first domain rule in list order that matches
+	Lookup(domain string) (Rule, bool)
+}
+
+// Decide returns the policy of the first rule matching domain, or DIRECT when none does
+func Decide(m Matcher, domain string) Policy {
+	if rule, ok := m.Lookup(domain); ok {
+		return rule.Policy
+	}
+	return PolicyDirect
+}
+
+// DecideAnswer is Decide for a name resolved to addr. Matchers that also hold IP and GEOIP
+// rules, like Set, take the address into account.
+func DecideAnswer(m Matcher, domain string, addr netip.Addr) Policy {
+	if am, ok := m.(interface {
+		DecideAnswer(string, netip.Addr) Policy
+	}); ok {
+		return am.DecideAnswer(domain, addr)
+	}
+	return Decide(m, domain)
+}
+
+// DomainTrie holds domain suffixes as a trie of labels stored right to left
+// ("com" → "example" → "www"), so a lookup costs one step per label of the
+// queried name regardless of how many suffixes it holds.
+type DomainTrie struct {
+	root trieNode
+	size int
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	terminal bool // a suffix ends at this label
+	index    int  // order in which that suffix was added; the earliest is kept
+}
+
+// NewDomainTrie compiles the given suffixes into a trie
+func NewDomainTrie(suffixes []string) *DomainTrie {
+	t := &DomainTrie{}
+	for _, suffix := range suffixes {
+		t.Add(suffix)
+	}
+	return t
+}
+
+// Add inserts a suffix; it then matches itself and every subdomain on label boundaries
+func (t *DomainTrie) Add(suffix string) {
+	t.add(suffix, t.size)
+}
+
+func (t *DomainTrie) add(suffix string, index int) {
+	suffix = strings.TrimPrefix(normalize(suffix), ".")
+	if suffix == "" {
+		return
+	}
+
+	node := &t.root
+	for end := len(suffix); end > 0; {
+		start := strings.LastIndexByte(suffix[:end], '.') + 1
+		label := suffix[start:end]
+		next, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*trieNode)
+			}
+			next = &trieNode{}
+			node.children[label] = next
+		}
+		node = next
+		end = start - 1
+	}
+	if !node.terminal {
+		node.terminal, node.index = true, index
+		t.size++
+	} else if index < node.index {
+		node.index = index
+	}
+}
+
+// Match reports whether domain equals one of the suffixes or is a subdomain of one
+func (t *DomainTrie) Match(domain string) bool {
+	_, ok := t.first(domain, false)
+	return ok
+}
+
+// first returns the earliest-added suffix covering domain. With all false it stops at
+// the first suffix found walking from the top-level label, which is enough for Match.
+func (t *DomainTrie) first(domain string, all bool) (int, bool) {
+	domain = normalize(domain)
+
+	best, found := 0, false
+	node := &t.root
+	for end := len(domain); end > 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		next, ok := node.children[domain[start:end]]
+		if !ok {
+			break
+		}
+		if next.terminal && (!found || next.index < best) {
+			best, found = next.index, true
+			if !all {
+				break
+			}
+		}
+		node = next
+		end = start - 1
+	}
+	return best, found
+}
+
+// Len returns the number of distinct suffixes in the trie
+func (t *DomainTrie) Len() int {
+	return t.size
+}
@@ -0,0 +1,57 @@
+package ruleset_test
+
+import (
+	"fmt"
+	"testing"
+
+	"openvpnadvanced/ruleset"
+)
+
+// syntheticSuffixes returns n distinct two- and three-label suffixes
+func syntheticSuffixes(n int) []string {
+	suffixes := make([]string, n)
+	for i := range suffixes {
+		if i%2 == 0 {
+			suffixes[i] = fmt.Sprintf("site%d.com", i)
+		} else {
+			suffixes[i] = fmt.Sprintf("cdn.service%d.net", i)
+		}
+	}
+	return suffixes
+}
+
+var benchmarkDomains = []string{
+	"www.site0.com",           // matches
+	"static.cdn.service1.net", // matches
+	"img.example.org",         // misses on the first label
+	"a.b.c.nosuchsite.com",    // misses deeper in the trie
+}
+
+// BenchmarkDomainTrie shows lookup cost stays flat as the number of rules grows
+func BenchmarkDomainTrie(b *testing.B) {
+	for _, n := range []int{1_000, 10_000, 100_000} {
+		trie := ruleset.NewDomainTrie(syntheticSuffixes(n))
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				trie.Match(benchmarkDomains[i%len(benchmarkDomains)])
+			}
+		})
+	}
+}
+
+// BenchmarkLinearScan is the previous rule-by-rule loop, for comparison
+func BenchmarkLinearScan(b *testing.B) {
+	for _, n := range []int{1_000, 10_000, 100_000} {
+		suffixes := syntheticSuffixes(n)
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				domain := benchmarkDomains[i%len(benchmarkDomains)]
+				for _, suffix := range suffixes {
+					if ruleset.HasDomainSuffix(domain, suffix) {
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package ruleset_test
+
+import (
+	"openvpnadvanced/ruleset"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DomainTrie", func() {
+	var trie *ruleset.DomainTrie
+
+	BeforeEach(func() {
+		trie = ruleset.NewDomainTrie([]string{"x.com", "Google.com.", ".corp.example", "cn", ""})
+	})
+
+	DescribeTable("Match",
+		func(domain string, want bool) {
+			Expect(trie.Match(domain)).To(Equal(want))
+		},
+		Entry("exact suffix", "x.com", true),
+		Entry("subdomain", "a.b.x.com", true),
+		Entry("partial label", "fox.com", false),
+		Entry("parent of a suffix", "com", false),
+		Entry("suffix added with capitals and a root dot", "maps.google.com", true),
+		Entry("queried with capitals and a root dot", "MAPS.Google.COM.", true),
+		Entry("suffix added with a leading dot", "vpn.corp.example", true),
+		Entry("top-level suffix", "baidu.cn", true),
+		Entry("unmatched name", "example.org", false),
+		Entry("empty name", "", false),
+	)
+
+	It("counts distinct suffixes", func() {
+		trie.Add("X.com")
+		Expect(trie.Len()).To(Equal(4))
+	})
+
+	It("agrees with HasDomainSuffix", func() {
+		suffixes := []string{"x.com", "a.b.c", "example.co.uk"}
+		domains := []string{"x.com", "fox.com", "www.x.com", "b.c", "z.a.b.c", "example.co.uk", "co.uk", "myexample.co.uk"}
+
+		trie := ruleset.NewDomainTrie(suffixes)
+		for _, domain := range domains {
+			want := false
+			for _, suffix := range suffixes {
+				want = want || ruleset.HasDomainSuffix(domain, suffix)
+			}
+			Expect(trie.Match(domain)).To(Equal(want), domain)
+		}
+	})
+})
@@ -0,0 +1,37 @@
+package ruleset
+
+import "strings"
+
+// Policy is what happens to traffic for a matched name or address
+type Policy int
+
+const (
+	PolicyDirect Policy = iota // use the default route; also the verdict when no rule matches
+	PolicyVPN                  // route through the VPN interface
+	PolicyReject               // refuse to resolve the name
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyVPN:
+		return "VPN"
+	case PolicyReject:
+		return "REJECT"
+	default:
+		return "DIRECT"
+	}
+}
+
+// ParsePolicy maps a rule's policy field to a Policy. Rules without one belong to a VPN
+// list, and proxy group names from Clash/Surge configs (Proxy, PROXY, ...) also mean VPN.
+func ParsePolicy(name string) Policy {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	switch {
+	case name == "DIRECT":
+		return PolicyDirect
+	case name == "REJECT" || strings.HasPrefix(name, "REJECT-"):
+		return PolicyReject
+	default:
+		return PolicyVPN
+	}
+}
@@ -0,0 +1,159 @@
+package ruleset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Type is the kind of a Clash/Surge rule
+type Type string
+
+const (
+	TypeDomain        Type = "DOMAIN"         // exact domain name
+	TypeDomainSuffix  Type = "DOMAIN-SUFFIX"  // domain and its subdomains
+	TypeDomainKeyword Type = "DOMAIN-KEYWORD" // substring of the domain name
+	TypeDomainRegex   Type = "DOMAIN-REGEX"   // regular expression over the domain name
+	TypeIPCIDR        Type = "IP-CIDR"        // network of the resolved address
+	TypeIPCIDR6       Type = "IP-CIDR6"       // same as IP-CIDR, conventionally for IPv6 networks
+	TypeGeoIP         Type = "GEOIP"          // country of the resolved address
+)
+
+// optionNoResolve marks an IP rule that only applies to addresses known without a DNS lookup
+const optionNoResolve = "no-resolve"
+
+// Rule is one parsed line of a rule list, e.g. "IP-CIDR,10.0.0.0/8,DIRECT,no-resolve"
+type Rule struct {
+	Type      Type
+	Value     string // normalised: lowercase domain, masked prefix or uppercase country code
+	Policy    Policy // VPN when the line has no policy field
+	NoResolve bool
+
+	regex  *regexp.Regexp
+	prefix netip.Prefix
+	index  int // position in the compiled list; lower wins
+}
+
+// String formats the rule back into list syntax
+func (r Rule) String() string {
+	fields := []string{string(r.Type), r.Value, r.Policy.String()}
+	if r.NoResolve {
+		fields = append(fields, optionNoResolve)
+	}
+	return strings.Join(fields, ",")
+}
+
+// Prefix returns the network of an IP-CIDR or IP-CIDR6 rule
+func (r Rule) Prefix() netip.Prefix {
+	return r.prefix
+}
+
+// ParseError describes a rule list line that was not understood
+type ParseError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d %q: %v", e.Line, e.Text, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseRule parses one rule in Clash/Surge syntax: TYPE,VALUE[,POLICY][,no-resolve].
+// DIRECT and REJECT are recognised as policies; anything else, or none, means VPN.
+func ParseRule(line string) (Rule, error) {
+	return parseRule(line, PolicyVPN)
+}
+
+// parseRule is ParseRule with the policy given to lines that have none
+func parseRule(line string, fallback Policy) (Rule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 2 || fields[1] == "" {
+		return Rule{}, fmt.Errorf("expected TYPE,VALUE")
+	}
+
+	rule := Rule{Type: Type(strings.ToUpper(fields[0])), Policy: fallback}
+	policy := ""
+	for _, opt := range fields[2:] {
+		switch {
+		case strings.EqualFold(opt, optionNoResolve):
+			rule.NoResolve = true
+		case opt == "":
+		case policy == "":
+			policy = opt
+			rule.Policy = ParsePolicy(opt)
+		default:
+			return Rule{}, fmt.Errorf("unsupported option %q", opt)
+		}
+	}
+
+	value := fields[1]
+	switch rule.Type {
+	case TypeDomain, TypeDomainSuffix, TypeDomainKeyword:
+		rule.Value = strings.TrimPrefix(normalize(value), ".")
+		if rule.Value == "" {
+			return Rule{}, fmt.Errorf("empty domain")
+		}
+	case TypeDomainRegex:
+		re, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid regex: %v", err)
+		}
+		rule.Value, rule.regex = value, re
+	case TypeIPCIDR, TypeIPCIDR6:
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid network: %v", err)
+		}
+		rule.prefix = prefix.Masked()
+		rule.Value = rule.prefix.String()
+	case TypeGeoIP:
+		rule.Value = strings.ToUpper(value)
+	default:
+		return Rule{}, fmt.Errorf("unsupported rule type %s", fields[0])
+	}
+	return rule, nil
+}
+
+// Parse reads a rule list, skipping blank lines and # or // comments. Lines that are
+// not understood are returned as ParseErrors rather than aborting the whole list.
+func Parse(r io.Reader) ([]Rule, []*ParseError, error) {
+	var rules []Rule
+	var unsupported []*ParseError
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			unsupported = append(unsupported, &ParseError{Line: n, Text: line, Err: err})
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, unsupported, scanner.Err()
+}
+
+// ParseFile is Parse for a rule list on disk
+func ParseFile(path string) ([]Rule, []*ParseError, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
@@ -0,0 +1,88 @@
+package ruleset_test
+
+import (
+	"strings"
+
+	"openvpnadvanced/ruleset"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rule parsing", func() {
+	DescribeTable("ParseRule accepts",
+		func(line string, want ruleset.Rule) {
+			rule, err := ruleset.ParseRule(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rule.Type).To(Equal(want.Type))
+			Expect(rule.Value).To(Equal(want.Value))
+			Expect(rule.Policy).To(Equal(want.Policy))
+			Expect(rule.NoResolve).To(Equal(want.NoResolve))
+		},
+		Entry("DOMAIN", "DOMAIN,ChatGPT.com", ruleset.Rule{Type: ruleset.TypeDomain, Value: "chatgpt.com", Policy: ruleset.PolicyVPN}),
+		Entry("DOMAIN-SUFFIX with a policy", "DOMAIN-SUFFIX,google.com,VPN", ruleset.Rule{Type: ruleset.TypeDomainSuffix, Value: "google.com", Policy: ruleset.PolicyVPN}),
+		Entry("DOMAIN-KEYWORD", "DOMAIN-KEYWORD,openai", ruleset.Rule{Type: ruleset.TypeDomainKeyword, Value: "openai", Policy: ruleset.PolicyVPN}),
+		Entry("DOMAIN-REGEX", `DOMAIN-REGEX,^ads?\d*\.`, ruleset.Rule{Type: ruleset.TypeDomainRegex, Value: `^ads?\d*\.`, Policy: ruleset.PolicyVPN}),
+		Entry("IP-CIDR with no-resolve", "IP-CIDR,74.125.0.1/16,no-resolve", ruleset.Rule{Type: ruleset.TypeIPCIDR, Value: "74.125.0.0/16", NoResolve: true, Policy: ruleset.PolicyVPN}),
+		Entry("IP-CIDR with policy and no-resolve", "IP-CIDR,10.0.0.0/8,DIRECT,no-resolve", ruleset.Rule{Type: ruleset.TypeIPCIDR, Value: "10.0.0.0/8", Policy: ruleset.PolicyDirect, NoResolve: true}),
+		Entry("IP-CIDR6", "IP-CIDR6,2620:120:e000::/40,no-resolve", ruleset.Rule{Type: ruleset.TypeIPCIDR6, Value: "2620:120:e000::/40", NoResolve: true, Policy: ruleset.PolicyVPN}),
+		Entry("GEOIP", "GEOIP,cn,DIRECT", ruleset.Rule{Type: ruleset.TypeGeoIP, Value: "CN", Policy: ruleset.PolicyDirect}),
+		Entry("spaces around fields and a lowercase type", " domain-suffix , x.com , VPN ", ruleset.Rule{Type: ruleset.TypeDomainSuffix, Value: "x.com", Policy: ruleset.PolicyVPN}),
+	)
+
+	DescribeTable("ParseRule rejects",
+		func(line string) {
+			_, err := ruleset.ParseRule(line)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("unsupported type", "PROCESS-NAME,BackupandSync"),
+		Entry("another unsupported type", "IP-ASN,20473,no-resolve"),
+		Entry("missing value", "DOMAIN-SUFFIX"),
+		Entry("empty value", "DOMAIN-SUFFIX,"),
+		Entry("bad network", "IP-CIDR,300.1.1.0/24"),
+		Entry("regex RE2 cannot compile", `DOMAIN-REGEX,^(?!www)`),
+		Entry("unknown option after the policy", "DOMAIN,x.com,VPN,extended-matching"),
+	)
+
+	DescribeTable("ParsePolicy",
+		func(name string, want ruleset.Policy) {
+			Expect(ruleset.ParsePolicy(name)).To(Equal(want))
+		},
+		Entry("no policy", "", ruleset.PolicyVPN),
+		Entry("VPN", "VPN", ruleset.PolicyVPN),
+		Entry("proxy group name", "Proxy", ruleset.PolicyVPN),
+		Entry("DIRECT", "direct", ruleset.PolicyDirect),
+		Entry("REJECT", "REJECT", ruleset.PolicyReject),
+		Entry("REJECT variant", "REJECT-TINYGIF", ruleset.PolicyReject),
+	)
+
+	It("formats rules back into list syntax", func() {
+		rule, err := ruleset.ParseRule("ip-cidr,10.0.0.0/8,DIRECT,NO-RESOLVE")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rule.String()).To(Equal("IP-CIDR,10.0.0.0/8,DIRECT,no-resolve"))
+
+		rule, err = ruleset.ParseRule("DOMAIN-SUFFIX,x.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rule.String()).To(Equal("DOMAIN-SUFFIX,x.com,VPN"))
+	})
+
+	It("reports unsupported lines with their line numbers", func() {
+		list := strings.Join([]string{
+			"# comment",
+			"DOMAIN-SUFFIX,x.com",
+			"",
+			"PROCESS-NAME,com.android.vending",
+			"// another comment",
+			"USER-AGENT,Google.Drive*",
+			"DOMAIN,chatgpt.com",
+		}, "\n")
+
+		rules, unsupported, err := ruleset.Parse(strings.NewReader(list))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(HaveLen(2))
+		Expect(unsupported).To(HaveLen(2))
+		Expect(unsupported[0].Line).To(Equal(4))
+		Expect(unsupported[1].Line).To(Equal(6))
+		Expect(unsupported[1].Error()).To(ContainSubstring("USER-AGENT"))
+	})
+})
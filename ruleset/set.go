@@ -0,0 +1,189 @@
+package ruleset
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Set is a rule list compiled for first-match evaluation. Domain rules are checked against
+// the queried name and IP rules against the addresses in the answer; when several rules
+// apply, the one listed first decides.
+type Set struct {
+	rules    []Rule
+	domains  *DomainTrie    // DOMAIN-SUFFIX, indexed by rule position
+	exact    map[string]int // DOMAIN
+	keywords []Rule         // DOMAIN-KEYWORD, in list order
+	regexes  []Rule         // DOMAIN-REGEX, in list order
+	networks []Rule         // IP-CIDR, IP-CIDR6 and GEOIP without no-resolve, in list order
+
+	geoip   GeoIP
+	outside string
+}
+
+// GeoIP tells which country an address belongs to
+type GeoIP interface {
+	Contains(code string, addr netip.Addr) bool
+}
+
+// Compile builds a Set from parsed rules, keeping their order
+func Compile(rules []Rule) *Set {
+	s := &Set{rules: make([]Rule, len(rules)), domains: &DomainTrie{}, exact: make(map[string]int)}
+	for i, rule := range rules {
+		rule.index = i
+		s.rules[i] = rule
+
+		switch rule.Type {
+		case TypeDomain:
+			if _, ok := s.exact[rule.Value]; !ok {
+				s.exact[rule.Value] = i
+			}
+		case TypeDomainSuffix:
+			s.domains.add(rule.Value, i)
+		case TypeDomainKeyword:
+			s.keywords = append(s.keywords, rule)
+		case TypeDomainRegex:
+			s.regexes = append(s.regexes, rule)
+		case TypeIPCIDR, TypeIPCIDR6, TypeGeoIP:
+			// no-resolve 规则只适用于直接以 IP 访问的流量，不用于匹配 DNS 应答
+			if !rule.NoResolve {
+				s.networks = append(s.networks, rule)
+			}
+		}
+	}
+	return s
+}
+
+// UseGeoIP lets GEOIP rules match answer addresses through db. When outside is a country
+// code, names no rule decides are routed through the VPN if their answer lies outside it.
+func (s *Set) UseGeoIP(db GeoIP, outside string) {
+	s.geoip = db
+	s.outside = strings.ToUpper(outside)
+}
+
+// Rules returns the rules the set was compiled from
+func (s *Set) Rules() []Rule {
+	return s.rules
+}
+
+// Match reports whether domain is matched by a DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD or DOMAIN-REGEX rule
+func (s *Set) Match(domain string) bool {
+	_, ok := s.Lookup(domain)
+	return ok
+}
+
+// Lookup returns the first domain rule, in list order, that matches domain
+func (s *Set) Lookup(domain string) (Rule, bool) {
+	domain = normalize(domain)
+	if domain == "" {
+		return Rule{}, false
+	}
+
+	best := len(s.rules)
+	if i, ok := s.exact[domain]; ok {
+		best = i
+	}
+	if i, ok := s.domains.first(domain, true); ok && i < best {
+		best = i
+	}
+	for _, rule := range s.keywords {
+		if rule.index >= best {
+			break
+		}
+		if strings.Contains(domain, rule.Value) {
+			best = rule.index
+			break
+		}
+	}
+	for _, rule := range s.regexes {
+		if rule.index >= best {
+			break
+		}
+		if rule.regex.MatchString(domain) {
+			best = rule.index
+			break
+		}
+	}
+
+	if best == len(s.rules) {
+		return Rule{}, false
+	}
+	return s.rules[best], true
+}
+
+// LookupIP returns the first IP-CIDR, IP-CIDR6 or GEOIP rule containing an answer address.
+// GEOIP rules never match without a database.
+func (s *Set) LookupIP(addr netip.Addr) (Rule, bool) {
+	addr = addr.Unmap()
+	for _, rule := range s.networks {
+		if rule.Type == TypeGeoIP {
+			if s.geoip != nil && s.geoip.Contains(rule.Value, addr) {
+				return rule, true
+			}
+			continue
+		}
+		if rule.prefix.Contains(addr) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// MatchIP reports whether an answer address falls inside an IP-CIDR, IP-CIDR6 or GEOIP rule
+func (s *Set) MatchIP(addr netip.Addr) bool {
+	_, ok := s.LookupIP(addr)
+	return ok
+}
+
+// LookupAnswer returns the first rule matching either the queried domain or one of its
+// answer addresses, so an IP rule listed before a domain rule takes precedence
+func (s *Set) LookupAnswer(domain string, addr netip.Addr) (Rule, bool) {
+	rule, ok := s.Lookup(domain)
+	if ipRule, ipOK := s.LookupIP(addr); ipOK && (!ok || ipRule.index < rule.index) {
+		return ipRule, true
+	}
+	return rule, ok
+}
+
+// DecideAnswer returns the policy for domain resolved to addr: that of the first rule
+// matching either, otherwise VPN when addr lies outside the UseGeoIP country, otherwise DIRECT
+func (s *Set) DecideAnswer(domain string, addr netip.Addr) Policy {
+	if rule, ok := s.LookupAnswer(domain, addr); ok {
+		return rule.Policy
+	}
+	// 局域网等本地地址不属于任何国家，不视为境外
+	addr = addr.Unmap()
+	if s.outside != "" && s.geoip != nil && addr.IsGlobalUnicast() && !addr.IsPrivate() && !s.geoip.Contains(s.outside, addr) {
+		return PolicyVPN
+	}
+	return PolicyDirect
+}
+
+// Routes returns the networks of the VPN-policy IP-CIDR and IP-CIDR6 rules, including
+// no-resolve ones, for installing as routes. A network inside an earlier IP rule is left
+// out, since that rule decides for all of its addresses. So is a network containing an
+// earlier non-VPN rule's network: routing it would send that rule's addresses through the
+// VPN too. Its answer addresses are still routed one by one.
+func (s *Set) Routes() []netip.Prefix {
+	var seen []Rule
+	var routes []netip.Prefix
+	for _, rule := range s.rules {
+		if rule.Type != TypeIPCIDR && rule.Type != TypeIPCIDR6 {
+			continue
+		}
+		skip := false
+		for _, prev := range seen {
+			// 被之前的规则覆盖，或包含之前的非 VPN 网段，都不能整段路由
+			covered := prev.prefix.Bits() <= rule.prefix.Bits() && prev.prefix.Contains(rule.prefix.Addr())
+			exempt := prev.Policy != PolicyVPN && rule.prefix.Bits() < prev.prefix.Bits() && rule.prefix.Contains(prev.prefix.Addr())
+			if covered || exempt {
+				skip = true
+				break
+			}
+		}
+		seen = append(seen, rule)
+		if !skip && rule.Policy == PolicyVPN {
+			routes = append(routes, rule.prefix)
+		}
+	}
+	return routes
+}
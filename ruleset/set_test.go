@@ -0,0 +1,183 @@
+package ruleset_test
+
+import (
+	"net/netip"
+	"strings"
+
+	"openvpnadvanced/ruleset"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Set", func() {
+	var set *ruleset.Set
+
+	BeforeEach(func() {
+		rules, unsupported, err := ruleset.Parse(strings.NewReader(strings.Join([]string{
+			"DOMAIN,chatgpt.com",
+			"DOMAIN-SUFFIX,x.com",
+			"DOMAIN-KEYWORD,google",
+			`DOMAIN-REGEX,^telemetry\d+\.`,
+			"IP-CIDR,192.0.2.0/24",
+			"IP-CIDR6,2001:db8::/32",
+			"IP-CIDR,198.51.100.0/24,no-resolve",
+			"GEOIP,CN,DIRECT",
+		}, "\n")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unsupported).To(BeEmpty())
+		set = ruleset.Compile(rules)
+	})
+
+	DescribeTable("Match",
+		func(domain string, want bool) {
+			Expect(set.Match(domain)).To(Equal(want))
+		},
+		Entry("DOMAIN matches the exact name", "chatgpt.com", true),
+		Entry("DOMAIN does not match subdomains", "ab.chatgpt.com", false),
+		Entry("DOMAIN-SUFFIX", "api.x.com", true),
+		Entry("DOMAIN-KEYWORD", "mail.googleusercontent.com", true),
+		Entry("DOMAIN-REGEX", "telemetry42.example.com", true),
+		Entry("DOMAIN-REGEX is anchored as written", "my.telemetry42.example.com", false),
+		Entry("nothing matches", "example.org", false),
+	)
+
+	DescribeTable("MatchIP",
+		func(ip string, want bool) {
+			Expect(set.MatchIP(netip.MustParseAddr(ip))).To(Equal(want))
+		},
+		Entry("inside IP-CIDR", "192.0.2.7", true),
+		Entry("IPv4-mapped address inside IP-CIDR", "::ffff:192.0.2.7", true),
+		Entry("inside IP-CIDR6", "2001:db8::1", true),
+		Entry("no-resolve rules are not matched against answers", "198.51.100.1", false),
+		Entry("outside every network", "203.0.113.1", false),
+	)
+	Describe("first-match policies", func() {
+		BeforeEach(func() {
+			rules, unsupported, err := ruleset.Parse(strings.NewReader(strings.Join([]string{
+				"DOMAIN-SUFFIX,corp.example.com,DIRECT",
+				"DOMAIN,maps.google.com,DIRECT",
+				"IP-CIDR,192.0.2.0/24,DIRECT",
+				"DOMAIN-SUFFIX,google.com,VPN",
+				"DOMAIN-KEYWORD,example",
+				"DOMAIN-SUFFIX,ads.example.net,REJECT",
+				"IP-CIDR,198.51.100.0/24,VPN",
+			}, "\n")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(unsupported).To(BeEmpty())
+			set = ruleset.Compile(rules)
+		})
+
+		DescribeTable("Decide",
+			func(domain string, want ruleset.Policy) {
+				Expect(ruleset.Decide(set, domain)).To(Equal(want))
+			},
+			Entry("VPN rule", "www.google.com", ruleset.PolicyVPN),
+			Entry("exclusion listed before the VPN rule", "maps.google.com", ruleset.PolicyDirect),
+			Entry("always DIRECT", "vpn.corp.example.com", ruleset.PolicyDirect),
+			Entry("rule without a policy means VPN", "example.org", ruleset.PolicyVPN),
+			Entry("an earlier keyword beats a later REJECT suffix", "ads.example.net", ruleset.PolicyVPN),
+			Entry("no match is DIRECT", "wikipedia.org", ruleset.PolicyDirect),
+		)
+
+		It("reports the rule that decided", func() {
+			rule, ok := set.Lookup("maps.google.com")
+			Expect(ok).To(BeTrue())
+			Expect(rule.String()).To(Equal("DOMAIN,maps.google.com,DIRECT"))
+		})
+
+		It("lets an earlier IP rule override a later domain rule for that address", func() {
+			rule, ok := set.LookupAnswer("www.google.com", netip.MustParseAddr("192.0.2.1"))
+			Expect(ok).To(BeTrue())
+			Expect(rule.Policy).To(Equal(ruleset.PolicyDirect))
+
+			rule, _ = set.LookupAnswer("www.google.com", netip.MustParseAddr("203.0.113.1"))
+			Expect(rule.Policy).To(Equal(ruleset.PolicyVPN))
+		})
+
+		It("keeps an earlier domain rule ahead of a later IP rule", func() {
+			rule, ok := set.LookupAnswer("maps.google.com", netip.MustParseAddr("198.51.100.1"))
+			Expect(ok).To(BeTrue())
+			Expect(rule.Policy).To(Equal(ruleset.PolicyDirect))
+
+			rule, _ = set.LookupAnswer("wikipedia.org", netip.MustParseAddr("198.51.100.1"))
+			Expect(rule.Policy).To(Equal(ruleset.PolicyVPN))
+		})
+	})
+
+	It("lists the networks of VPN IP rules as routes", func() {
+		rules, _, err := ruleset.Parse(strings.NewReader(strings.Join([]string{
+			"DOMAIN-SUFFIX,telegram.org",
+			"IP-CIDR,10.0.0.0/8,DIRECT",
+			"IP-CIDR,10.1.0.0/16",
+			"IP-CIDR,91.108.4.0/22,VPN,no-resolve",
+			"IP-CIDR,91.108.5.0/24",
+			"IP-CIDR6,2001:b28:f23d::/48,VPN",
+			"IP-CIDR,192.0.2.0/24,REJECT",
+		}, "\n")))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ruleset.Compile(rules).Routes()).To(Equal([]netip.Prefix{
+			netip.MustParsePrefix("91.108.4.0/22"),
+			netip.MustParsePrefix("2001:b28:f23d::/48"),
+		}))
+	})
+
+	It("does not route a VPN network that contains an earlier non-VPN network", func() {
+		rules, _, err := ruleset.Parse(strings.NewReader(strings.Join([]string{
+			"IP-CIDR,10.1.0.0/16,DIRECT",
+			"IP-CIDR,10.0.0.0/8,VPN",
+			"IP-CIDR,172.16.1.0/24,VPN",
+			"IP-CIDR,172.16.0.0/12,VPN",
+		}, "\n")))
+		Expect(err).NotTo(HaveOccurred())
+
+		set := ruleset.Compile(rules)
+		Expect(set.Routes()).To(Equal([]netip.Prefix{
+			netip.MustParsePrefix("172.16.1.0/24"),
+			netip.MustParsePrefix("172.16.0.0/12"),
+		}))
+		// 首个命中的规则仍然决定应答地址
+		Expect(set.DecideAnswer("a.example", netip.MustParseAddr("10.1.2.3"))).To(Equal(ruleset.PolicyDirect))
+		Expect(set.DecideAnswer("a.example", netip.MustParseAddr("10.2.2.3"))).To(Equal(ruleset.PolicyVPN))
+	})
+
+	Describe("GeoIP", func() {
+		BeforeEach(func() {
+			rules, _, err := ruleset.Parse(strings.NewReader(strings.Join([]string{
+				"DOMAIN-SUFFIX,google.com,VPN",
+				"GEOIP,CN,DIRECT",
+				"DOMAIN-SUFFIX,baidu.com,VPN",
+			}, "\n")))
+			Expect(err).NotTo(HaveOccurred())
+			set = ruleset.Compile(rules)
+		})
+
+		It("never matches GEOIP rules without a database", func() {
+			Expect(set.MatchIP(netip.MustParseAddr("1.0.1.1"))).To(BeFalse())
+			Expect(set.DecideAnswer("www.baidu.com", netip.MustParseAddr("1.0.1.1"))).To(Equal(ruleset.PolicyVPN))
+		})
+
+		DescribeTable("DecideAnswer",
+			func(outside, domain, ip string, want ruleset.Policy) {
+				set.UseGeoIP(fakeGeoIP{"CN": netip.MustParsePrefix("1.0.0.0/16")}, outside)
+				Expect(set.DecideAnswer(domain, netip.MustParseAddr(ip))).To(Equal(want))
+			},
+			Entry("GEOIP matches the answer address", "", "www.baidu.com", "1.0.1.1", ruleset.PolicyDirect),
+			Entry("an earlier domain rule wins", "", "www.google.com", "1.0.1.1", ruleset.PolicyVPN),
+			Entry("a later domain rule applies outside the country", "", "www.baidu.com", "8.8.8.8", ruleset.PolicyVPN),
+			Entry("unmatched names stay DIRECT without outside mode", "", "example.org", "8.8.8.8", ruleset.PolicyDirect),
+			Entry("outside mode routes foreign answers via VPN", "cn", "example.org", "8.8.8.8", ruleset.PolicyVPN),
+			Entry("outside mode keeps domestic answers DIRECT", "CN", "example.org", "1.0.200.1", ruleset.PolicyDirect),
+			Entry("outside mode ignores private addresses", "CN", "nas.lan", "192.168.1.10", ruleset.PolicyDirect),
+		)
+	})
+})
+
+// fakeGeoIP maps country codes to a single network
+type fakeGeoIP map[string]netip.Prefix
+
+func (f fakeGeoIP) Contains(code string, addr netip.Addr) bool {
+	prefix, ok := f[code]
+	return ok && prefix.Contains(addr)
+}
@@ -0,0 +1,21 @@
+// Package ruleset matches domain names against routing rules.
+package ruleset
+
+import "strings"
+
+// HasDomainSuffix reports whether domain equals suffix or is a subdomain of it. The
+// comparison is case-insensitive and only matches on label boundaries, so "x.com"
+// matches "x.com" and "a.x.com" but not "fox.com".
+func HasDomainSuffix(domain, suffix string) bool {
+	domain = normalize(domain)
+	suffix = strings.TrimPrefix(normalize(suffix), ".")
+	if suffix == "" || !strings.HasSuffix(domain, suffix) {
+		return false
+	}
+	return len(domain) == len(suffix) || domain[len(domain)-len(suffix)-1] == '.'
+}
+
+// normalize lowercases a domain name and strips the trailing root dot
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
@@ -0,0 +1,29 @@
+package ruleset_test
+
+import (
+	"openvpnadvanced/ruleset"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("HasDomainSuffix",
+	func(domain, suffix string, want bool) {
+		Expect(ruleset.HasDomainSuffix(domain, suffix)).To(Equal(want))
+	},
+	Entry("exact match", "x.com", "x.com", true),
+	Entry("subdomain", "www.x.com", "x.com", true),
+	Entry("deep subdomain", "a.b.c.x.com", "x.com", true),
+	Entry("label that only ends with the suffix", "fox.com", "x.com", false),
+	Entry("another partial label", "netflix.com", "x.com", false),
+	Entry("partial label in a subdomain", "www.dropbox.com", "x.com", false),
+	Entry("suffix longer than the domain", "x.com", "www.x.com", false),
+	Entry("case-insensitive", "WWW.X.Com", "x.COM", true),
+	Entry("fully qualified domain", "www.x.com.", "x.com", true),
+	Entry("fully qualified suffix", "www.x.com", "x.com.", true),
+	Entry("suffix written with a leading dot", "www.x.com", ".x.com", true),
+	Entry("leading-dot suffix still matches the bare name", "x.com", ".x.com", true),
+	Entry("top-level domain suffix", "example.cn", "cn", true),
+	Entry("top-level domain as a partial label", "example.xcn", "cn", false),
+	Entry("empty suffix matches nothing", "x.com", "", false),
+)
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"time"
 
+	"openvpnadvanced/cmd/config"
 	"openvpnadvanced/dnsmasq"
+	"openvpnadvanced/doh"
+	"openvpnadvanced/ruleset"
 	"openvpnadvanced/vpn"
 
 	"github.com/olekukonko/tablewriter"
@@ -21,21 +23,34 @@ func main() {
 	domain := os.Args[1]
 	fmt.Printf("🔍 Tracing domain: %s\n", domain)
 
-	// 1. Load routing rules
-	rules, err := dnsmasq.LoadDomainRules("assets/merged_rule.list")
+	// Use the configured DoH upstreams when config.ini is present
+	if err := config.LoadINIConfig("config.ini"); err == nil {
+		if client, err := doh.NewClient(config.GetConfig().Upstreams); err == nil {
+			doh.SetDefaultClient(client)
+		}
+	}
+
+	// 1. Load the GeoIP database and routing rules
+	geoDB, err := dnsmasq.LoadGeoIP(config.GetConfig().GeoIPDatabase, config.GetConfig().VPNOutside)
+	if err != nil {
+		log.Printf("GeoIP database not loaded: %v", err)
+	}
+	rules, err := dnsmasq.LoadRules("assets/merged_rule.list", config.GetConfig().BlockLists...)
 	if err != nil {
 		log.Fatalf("Failed to load rules: %v", err)
 	}
 
 	// 2. Load and prepare cache
-	rawCache, _ := dnsmasq.LoadCacheFromFile()
-	cache := dnsmasq.NewCacheWithTTL(10 * time.Minute)
-	for domain, record := range rawCache {
-		cache.Set(domain, record.IP)
+	// 只读加载：trace 可能与运行中的代理同时使用，不能移动或改写缓存文件
+	cachedEntries, err := dnsmasq.ReadCacheFile(config.GetConfig().CachePath)
+	if err != nil {
+		log.Printf("Cache not loaded: %v", err)
 	}
+	cache := dnsmasq.NewCache()
+	cache.Restore(cachedEntries)
 
 	// 3. Resolve domain (recursively handles CNAME)
-	shouldRoute, ip, cname := dnsmasq.ResolveWithCNAME(domain, rules, cache)
+	policy, ip, cname := dnsmasq.ResolveWithCNAME(doh.DefaultClient(), domain, dnsmasq.NewMatcher(rules, geoDB, config.GetConfig().VPNOutside), cache)
 	if ip == "" {
 		fmt.Println("❌ Failed to resolve domain.")
 		return
@@ -71,7 +86,7 @@ func main() {
 	networkTable.SetBorder(false)
 	networkTable.Append([]string{"Domain", domain})
 	networkTable.Append([]string{"Resolved IP", ip})
-	networkTable.Append([]string{"Matched Rule", map[bool]string{true: "VPN", false: "DIRECT"}[shouldRoute]})
+	networkTable.Append([]string{"Matched Rule", policy.String()})
 	if cname != "" && cname != domain {
 		networkTable.Append([]string{"CNAME Chain", domain + " -> " + cname})
 	}
@@ -91,7 +106,7 @@ func main() {
 	routeTable.Render()
 
 	// Check if routing is optimal
-	if shouldRoute && currentIface != vpnIface {
+	if policy == ruleset.PolicyVPN && currentIface != vpnIface {
 		fmt.Println("\n⚠️ Warning: Domain should be routed through VPN but is using direct connection")
 		fmt.Printf("Attempting to fix routing...\n")
 		if err := vpn.AddRoute(ip, vpnIface); err != nil {
@@ -102,7 +117,7 @@ func main() {
 			currentIface, _ = vpn.GetRouteInterface(ip)
 			fmt.Printf("Updated routing interface: %s\n", currentIface)
 		}
-	} else if !shouldRoute && currentIface == vpnIface {
+	} else if policy != ruleset.PolicyVPN && currentIface == vpnIface {
 		fmt.Println("\n⚠️ Warning: Domain should be routed directly but is using VPN")
 		fmt.Println("Suggestion: Check routing rule configuration")
 	} else {
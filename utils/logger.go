@@ -3,9 +3,10 @@ package utils
 import "fmt"
 
 const (
-	ColorReset = "\033[0m"
-	ColorRed   = "\033[31m"
-	ColorGreen = "\033[32m"
+	ColorReset  = "\033[0m"
+	ColorRed    = "\033[31m"
+	ColorGreen  = "\033[32m"
+	ColorYellow = "\033[33m"
 )
 
 // PrintVPN prints a VPN-tagged message in green
@@ -18,6 +19,11 @@ func PrintDirect(domain, ip string) {
 	fmt.Printf("[DIRECT] %-20s ➜ %s\n", domain, ip)
 }
 
+// PrintBlock prints a blocked-query message in yellow
+func PrintBlock(domain, answer string) {
+	fmt.Printf("%s[BLOCK] %-20s ➜ %s%s\n", ColorYellow, domain, answer, ColorReset)
+}
+
 // PrintError prints an error message in red
 func PrintError(domain, msg string) {
 	fmt.Printf("%s[ERROR] %-20s ➜ %s%s\n", ColorRed, domain, msg, ColorReset)
@@ -124,3 +124,77 @@ func GetDefaultGateway() (string, string, error) {
 
 	return "", "", fmt.Errorf("default gateway not found")
 }
+
+// FindVPNDNSServers returns the DNS servers pushed for the VPN interface (e.g. OpenVPN's dhcp-option DNS).
+// A resolver counts when scutil scopes it to the interface or its address lies inside the tunnel subnet.
+func FindVPNDNSServers(vpnInterface string) ([]string, error) {
+	iface, err := net.InterfaceByName(vpnInterface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := exec.Command("scutil", "--dns").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS configuration: %w", err)
+	}
+
+	inTunnel := func(ip net.IP) bool {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var servers []string
+	seen := make(map[string]bool)
+	var block []string
+	flush := func() {
+		scoped := false
+		for _, line := range block {
+			if strings.HasPrefix(line, "if_index") && strings.Contains(line, "("+vpnInterface+")") {
+				scoped = true
+			}
+		}
+		for _, line := range block {
+			if !strings.HasPrefix(line, "nameserver[") {
+				continue
+			}
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			server := strings.TrimSpace(parts[1])
+			ip := net.ParseIP(server)
+			if ip == nil || ip.IsLoopback() || seen[server] {
+				continue
+			}
+			if scoped || inTunnel(ip) {
+				seen[server] = true
+				servers = append(servers, server)
+			}
+		}
+		block = block[:0]
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "resolver #") {
+			flush()
+			continue
+		}
+		block = append(block, line)
+	}
+	flush()
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS server pushed for %s", vpnInterface)
+	}
+	return servers, nil
+}
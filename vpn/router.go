@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
@@ -40,6 +41,30 @@ func DeleteDefaultVPNRoutes() error {
 	return nil
 }
 
+// AddSubnetRoute adds a static route sending a whole network through the VPN interface
+func AddSubnetRoute(prefix netip.Prefix, vpnInterface string) error {
+	return runRoute("add", prefix, vpnInterface)
+}
+
+// DeleteSubnetRoute removes a route added by AddSubnetRoute
+func DeleteSubnetRoute(prefix netip.Prefix, vpnInterface string) error {
+	return runRoute("delete", prefix, vpnInterface)
+}
+
+func runRoute(action string, prefix netip.Prefix, iface string) error {
+	args := []string{"route", "-n", action}
+	if prefix.Addr().Is6() {
+		args = append(args, "-inet6")
+	}
+	args = append(args, "-net", prefix.String(), "-interface", iface)
+
+	cmd := exec.Command("sudo", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
 // ResolveIPv6 resolves domain to its IPv6 addresses
 func ResolveIPv6(domain string) ([]string, error) {
 	ips, err := net.LookupIP(domain)